@@ -63,6 +63,11 @@ func getTeams() ([]Team, error) {
 	return teams, nil
 }
 
+// FetchTeams fetches the teams of the current event
+func FetchTeams() ([]Team, error) {
+	return getTeams()
+}
+
 func getLadder() ([]LadderEntry, error) {
 	resp, err := http.Get(bplBaseUrl + "/events/current/ladder")
 	if err != nil {
@@ -0,0 +1,251 @@
+package guild_stash_logs
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Alert is raised when a stash entry matches an alert rule
+type Alert struct {
+	Rule    string          `json:"rule"`
+	Message string          `json:"message"`
+	Entry   GuildStashEntry `json:"entry"`
+}
+
+func (a Alert) String() string {
+	return fmt.Sprintf("[%s] %s: %s", time.Unix(a.Entry.Time, 0).Format("2006-01-02 15:04:05"), a.Rule, a.Message)
+}
+
+// AlertRule inspects stash entries one at a time in chronological order
+type AlertRule interface {
+	Name() string
+	// Check returns a message if the entry should raise an alert
+	Check(entry GuildStashEntry) (message string, alert bool)
+}
+
+// WithdrawalBurstRule alerts when an account removes more than MaxWithdrawals items within Window
+type WithdrawalBurstRule struct {
+	MaxWithdrawals int
+	Window         time.Duration
+	withdrawals    map[string][]int64
+}
+
+func (r *WithdrawalBurstRule) Name() string {
+	return "withdrawal burst"
+}
+
+func (r *WithdrawalBurstRule) Check(entry GuildStashEntry) (string, bool) {
+	if entry.Action != "removed" {
+		return "", false
+	}
+	if r.withdrawals == nil {
+		r.withdrawals = make(map[string][]int64)
+	}
+	account := entry.Account.Name
+	windowStart := entry.Time - int64(r.Window.Seconds())
+	recent := slices.DeleteFunc(r.withdrawals[account], func(t int64) bool {
+		return t <= windowStart
+	})
+	recent = append(recent, entry.Time)
+	r.withdrawals[account] = recent
+	// Only alert once when crossing the limit, not for every further withdrawal
+	if len(recent) != r.MaxWithdrawals+1 {
+		return "", false
+	}
+	return fmt.Sprintf("%s removed %d items within %v (last: %s from %s)", account, len(recent), r.Window, entry.Item, entry.Stash), true
+}
+
+// ProtectedTabRule alerts on every withdrawal from one of the protected tabs
+type ProtectedTabRule struct {
+	Tabs []string
+}
+
+func (r *ProtectedTabRule) Name() string {
+	return "protected tab"
+}
+
+func (r *ProtectedTabRule) Check(entry GuildStashEntry) (string, bool) {
+	if entry.Action != "removed" || !containsFold(r.Tabs, entry.Stash) {
+		return "", false
+	}
+	return fmt.Sprintf("%s removed %s from protected tab %s", entry.Account.Name, entry.Item, entry.Stash), true
+}
+
+// OutsiderWithdrawalRule alerts on withdrawals by accounts that are not on the team
+type OutsiderWithdrawalRule struct {
+	TeamAccounts []string
+}
+
+func (r *OutsiderWithdrawalRule) Name() string {
+	return "outsider withdrawal"
+}
+
+func (r *OutsiderWithdrawalRule) Check(entry GuildStashEntry) (string, bool) {
+	if entry.Action != "removed" || containsFold(r.TeamAccounts, entry.Account.Name) {
+		return "", false
+	}
+	return fmt.Sprintf("%s is not on the team and removed %s from %s", entry.Account.Name, entry.Item, entry.Stash), true
+}
+
+func containsFold(values []string, value string) bool {
+	return slices.ContainsFunc(values, func(v string) bool {
+		return strings.EqualFold(v, value)
+	})
+}
+
+// AlertSink delivers alerts somewhere
+type AlertSink interface {
+	Send(alert Alert) error
+}
+
+// ConsoleAlertSink shows alerts as notices of the progress reporter, so they don't break
+// the progress output
+type ConsoleAlertSink struct {
+	Progress ProgressReporter
+	GuildId  int
+}
+
+func (s ConsoleAlertSink) Send(alert Alert) error {
+	s.Progress.Report(ProgressEvent{Time: time.Now(), GuildId: s.GuildId, Message: "🚨 " + alert.String(), Percent: -1, Notice: true})
+	return nil
+}
+
+// FileAlertSink appends alerts to a log file
+type FileAlertSink struct {
+	Path string
+}
+
+func (s FileAlertSink) Send(alert Alert) error {
+	file, err := os.OpenFile(s.Path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintln(file, alert); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// WebhookAlertSink posts alerts to a webhook. The payload uses the "content" field,
+// so Discord webhooks can be used directly.
+type WebhookAlertSink struct {
+	Url string
+}
+
+// webhookClient gives up on webhooks that hang, alerts are sent from the monitoring loop
+var webhookClient = &http.Client{Timeout: 10 * time.Second}
+
+func (s WebhookAlertSink) Send(alert Alert) error {
+	body, err := json.Marshal(map[string]any{
+		"content": "🚨 " + alert.String(),
+	})
+	if err != nil {
+		return err
+	}
+	resp, err := webhookClient.Post(s.Url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
+
+// AlertOptions configures the alert rules and where alerts are sent to
+type AlertOptions struct {
+	// WithdrawalLimit is the number of withdrawals per account within WithdrawalWindow
+	// that is still fine. 0 disables the rule.
+	WithdrawalLimit  int
+	WithdrawalWindow time.Duration
+	ProtectedTabs    []string
+	// TeamAccounts enables the outsider rule if not empty. It applies to every guild without
+	// a list of its own in GuildTeamAccounts.
+	TeamAccounts []string
+	// GuildTeamAccounts are the team accounts of single guilds, by guild id
+	GuildTeamAccounts map[int][]string
+	LogFile           string
+	WebhookUrl        string
+}
+
+// teamAccounts returns the team accounts of a guild
+func (o AlertOptions) teamAccounts(guildId int) []string {
+	if accounts, ok := o.GuildTeamAccounts[guildId]; ok {
+		return accounts
+	}
+	return o.TeamAccounts
+}
+
+// AlertEngine runs every new stash entry through a set of rules and sends matches to all sinks
+type AlertEngine struct {
+	Rules []AlertRule
+	Sinks []AlertSink
+	// Progress shows alerts and problems sending them
+	Progress ProgressReporter
+	GuildId  int
+	mutex    sync.Mutex
+}
+
+// NewAlertEngine creates the rules and sinks of the options for a guild. Alerts are shown
+// through progress.
+func NewAlertEngine(options AlertOptions, guildId int, progress ProgressReporter) *AlertEngine {
+	engine := &AlertEngine{
+		Sinks:    []AlertSink{ConsoleAlertSink{Progress: progress, GuildId: guildId}},
+		Progress: progress,
+		GuildId:  guildId,
+	}
+	if options.WithdrawalLimit > 0 {
+		engine.Rules = append(engine.Rules, &WithdrawalBurstRule{MaxWithdrawals: options.WithdrawalLimit, Window: options.WithdrawalWindow})
+	}
+	if len(options.ProtectedTabs) > 0 {
+		engine.Rules = append(engine.Rules, &ProtectedTabRule{Tabs: options.ProtectedTabs})
+	}
+	if accounts := options.teamAccounts(guildId); len(accounts) > 0 {
+		engine.Rules = append(engine.Rules, &OutsiderWithdrawalRule{TeamAccounts: accounts})
+	}
+	if options.LogFile != "" {
+		engine.Sinks = append(engine.Sinks, FileAlertSink{Path: options.LogFile})
+	}
+	if options.WebhookUrl != "" {
+		engine.Sinks = append(engine.Sinks, WebhookAlertSink{Url: options.WebhookUrl})
+	}
+	return engine
+}
+
+// Process checks the entries oldest first and returns the alerts that were raised
+func (e *AlertEngine) Process(entries []GuildStashEntry) []Alert {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	sorted := slices.Clone(entries)
+	slices.SortStableFunc(sorted, func(a, b GuildStashEntry) int {
+		return cmp.Compare(a.Time, b.Time)
+	})
+	var alerts []Alert
+	for _, entry := range sorted {
+		for _, rule := range e.Rules {
+			message, matched := rule.Check(entry)
+			if !matched {
+				continue
+			}
+			alert := Alert{Rule: rule.Name(), Message: message, Entry: entry}
+			alerts = append(alerts, alert)
+			for _, sink := range e.Sinks {
+				if err := sink.Send(alert); err != nil {
+					e.Progress.Report(ProgressEvent{Time: time.Now(), GuildId: e.GuildId, Message: fmt.Sprintf("Warning: Could not send alert: %v", err), Percent: -1, Notice: true})
+				}
+			}
+		}
+	}
+	return alerts
+}
@@ -0,0 +1,308 @@
+package guild_stash_logs
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var archiveDir = "bpl-stash-archive"
+
+// ArchiveCursor records how far a history walk got, so an interrupted walk can resume
+// from the last page it stored instead of starting over
+type ArchiveCursor struct {
+	End       int64     `json:"end"`
+	FromId    string    `json:"from_id"`
+	Time      int64     `json:"time"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// StashArchive is an append-only local copy of a guild's stash history. Entries are
+// stored in one JSONL segment per UTC day and are deduplicated by their id.
+type StashArchive struct {
+	dir      string
+	mutex    sync.Mutex
+	ids      map[string]struct{}
+	earliest int64
+	latest   int64
+}
+
+func OpenStashArchive(guildId int) (*StashArchive, error) {
+	dir := filepath.Join(archiveDir, strconv.Itoa(guildId))
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create archive directory: %w", err)
+	}
+	archive := &StashArchive{
+		dir: dir,
+		ids: make(map[string]struct{}),
+	}
+	segments, err := archive.segments()
+	if err != nil {
+		return nil, err
+	}
+	for _, segment := range segments {
+		err := readSegment(segment, func(entry GuildStashEntry) {
+			archive.track(entry)
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to read archive segment %s: %w", segment, err)
+		}
+	}
+	return archive, nil
+}
+
+func (a *StashArchive) segments() ([]string, error) {
+	segments, err := filepath.Glob(filepath.Join(a.dir, "*.jsonl"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(segments)
+	return segments, nil
+}
+
+func (a *StashArchive) track(entry GuildStashEntry) {
+	a.ids[entry.Id] = struct{}{}
+	if a.earliest == 0 || entry.Time < a.earliest {
+		a.earliest = entry.Time
+	}
+	if entry.Time > a.latest {
+		a.latest = entry.Time
+	}
+}
+
+func readSegment(path string, fn func(GuildStashEntry)) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var entry GuildStashEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			// A crash can leave a partially written last line behind
+			fmt.Fprintf(os.Stderr, "Warning: skipping corrupt archive line in %s: %v\n", path, err)
+			continue
+		}
+		entry.Parsed = ParseItem(entry.Item)
+		fn(entry)
+	}
+	return scanner.Err()
+}
+
+// Has reports whether an entry with the given id is already archived
+func (a *StashArchive) Has(id string) bool {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	_, ok := a.ids[id]
+	return ok
+}
+
+// Bounds returns the time of the oldest and newest archived entry
+func (a *StashArchive) Bounds() (earliest, latest int64, ok bool) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return a.earliest, a.latest, len(a.ids) > 0
+}
+
+// Append stores all entries that are not archived yet and returns the ones that were new
+func (a *StashArchive) Append(entries []GuildStashEntry) ([]GuildStashEntry, error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	bySegment := make(map[string][]GuildStashEntry)
+	for _, entry := range entries {
+		if _, ok := a.ids[entry.Id]; ok {
+			continue
+		}
+		segment := time.Unix(entry.Time, 0).UTC().Format("2006-01-02") + ".jsonl"
+		bySegment[segment] = append(bySegment[segment], entry)
+	}
+
+	var added []GuildStashEntry
+	for segment, segmentEntries := range bySegment {
+		file, err := os.OpenFile(filepath.Join(a.dir, segment), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+		if err != nil {
+			return added, err
+		}
+		writer := bufio.NewWriter(file)
+		encoder := json.NewEncoder(writer)
+		for _, entry := range segmentEntries {
+			if err := encoder.Encode(entry); err != nil {
+				file.Close()
+				return added, err
+			}
+		}
+		if err := writer.Flush(); err != nil {
+			file.Close()
+			return added, err
+		}
+		if err := file.Close(); err != nil {
+			return added, err
+		}
+		for _, entry := range segmentEntries {
+			a.track(entry)
+		}
+		added = append(added, segmentEntries...)
+	}
+	return added, nil
+}
+
+// Entries returns all archived entries with start <= time <= end, newest first
+func (a *StashArchive) Entries(start, end int64) ([]GuildStashEntry, error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	segments, err := a.segments()
+	if err != nil {
+		return nil, err
+	}
+	firstDay := time.Unix(start, 0).UTC().Format("2006-01-02")
+	lastDay := time.Unix(end, 0).UTC().Format("2006-01-02")
+	var entries []GuildStashEntry
+	for _, segment := range segments {
+		day := filepath.Base(segment)[:len("2006-01-02")]
+		if day < firstDay || day > lastDay {
+			continue
+		}
+		err := readSegment(segment, func(entry GuildStashEntry) {
+			if entry.Time >= start && entry.Time <= end {
+				entries = append(entries, entry)
+			}
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].Time > entries[j].Time
+	})
+	return entries, nil
+}
+
+func (a *StashArchive) cursorPath() string {
+	return filepath.Join(a.dir, "cursor.json")
+}
+
+// Cursor returns the cursor of an unfinished walk, or nil if the last walk completed
+func (a *StashArchive) Cursor() (*ArchiveCursor, error) {
+	data, err := os.ReadFile(a.cursorPath())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	cursor := &ArchiveCursor{}
+	if err := json.Unmarshal(data, cursor); err != nil {
+		return nil, fmt.Errorf("failed to parse archive cursor: %w", err)
+	}
+	return cursor, nil
+}
+
+func (a *StashArchive) SaveCursor(cursor *ArchiveCursor) error {
+	cursor.UpdatedAt = time.Now()
+	data, err := json.Marshal(cursor)
+	if err != nil {
+		return err
+	}
+	tmp := a.cursorPath() + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, a.cursorPath())
+}
+
+func (a *StashArchive) ClearCursor() error {
+	err := os.Remove(a.cursorPath())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// WalkSegment is one time slice of a segmented history walk, walked from Start back to End
+type WalkSegment struct {
+	Start  int64  `json:"start"`
+	End    int64  `json:"end"`
+	FromId string `json:"from_id,omitempty"`
+	// Time is how far back the segment got so far
+	Time int64 `json:"time"`
+	Done bool  `json:"done"`
+}
+
+// WalkCheckpoint records the segments of an unfinished segmented history walk
+type WalkCheckpoint struct {
+	Start     int64         `json:"start"`
+	End       int64         `json:"end"`
+	Segments  []WalkSegment `json:"segments"`
+	UpdatedAt time.Time     `json:"updated_at"`
+}
+
+// walkKind keeps the checkpoints of different kinds of history walks apart, so a backfill
+// doesn't overwrite the walk the monitor resumes
+type walkKind string
+
+const (
+	monitorWalk  walkKind = ""
+	backfillWalk walkKind = "backfill"
+	// verifyWalk re-fetches the windows of a coverage check, which are short enough to not need
+	// a checkpoint
+	verifyWalk walkKind = "verify"
+)
+
+func (a *StashArchive) checkpointPath(kind walkKind) string {
+	if kind == monitorWalk {
+		return filepath.Join(a.dir, "walk-segments.json")
+	}
+	return filepath.Join(a.dir, string(kind)+"-segments.json")
+}
+
+// WalkCheckpoint returns the checkpoint of an unfinished segmented walk of the given kind, or
+// nil if there is none
+func (a *StashArchive) WalkCheckpoint(kind walkKind) (*WalkCheckpoint, error) {
+	data, err := os.ReadFile(a.checkpointPath(kind))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	checkpoint := &WalkCheckpoint{}
+	if err := json.Unmarshal(data, checkpoint); err != nil {
+		return nil, fmt.Errorf("failed to parse walk checkpoint: %w", err)
+	}
+	return checkpoint, nil
+}
+
+func (a *StashArchive) SaveWalkCheckpoint(kind walkKind, checkpoint *WalkCheckpoint) error {
+	checkpoint.UpdatedAt = time.Now()
+	data, err := json.Marshal(checkpoint)
+	if err != nil {
+		return err
+	}
+	tmp := a.checkpointPath(kind) + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, a.checkpointPath(kind))
+}
+
+func (a *StashArchive) ClearWalkCheckpoint(kind walkKind) error {
+	err := os.Remove(a.checkpointPath(kind))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,175 @@
+package guild_stash_logs
+
+import (
+	"slices"
+	"testing"
+)
+
+// testArchive opens an archive of guild 1 in a temporary directory
+func testArchive(t *testing.T) *StashArchive {
+	t.Helper()
+	dir := archiveDir
+	archiveDir = t.TempDir()
+	t.Cleanup(func() { archiveDir = dir })
+	archive, err := OpenStashArchive(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return archive
+}
+
+// entryIds returns the ids of the entries in order
+func entryIds(entries []GuildStashEntry) []string {
+	ids := make([]string, len(entries))
+	for i, entry := range entries {
+		ids[i] = entry.Id
+	}
+	return ids
+}
+
+func TestStashArchive(t *testing.T) {
+	const day = 24 * 60 * 60
+	entries := []GuildStashEntry{
+		stashEntry("1", 1000, "added", "a", "Divine Orb", 0, 0),
+		stashEntry("2", 2000, "added", "a", "Divine Orb", 0, 0),
+		stashEntry("3", 2000+day, "removed", "b", "Divine Orb", 0, 0),
+	}
+	tests := []struct {
+		name       string
+		appends    [][]GuildStashEntry
+		start, end int64
+		wantAdded  []string
+		// wantEntries are the ids of the entries between start and end, newest first
+		wantEntries []string
+	}{
+		{"single append", [][]GuildStashEntry{entries}, 0, 3 * day, []string{"1", "2", "3"}, []string{"3", "2", "1"}},
+		{"duplicates are skipped", [][]GuildStashEntry{entries[:2], entries}, 0, 3 * day, []string{"1", "2", "3"}, []string{"3", "2", "1"}},
+		{"window within a day", [][]GuildStashEntry{entries}, 1500, 2000, []string{"1", "2", "3"}, []string{"2"}},
+		{"window of the next day", [][]GuildStashEntry{entries}, day, 3 * day, []string{"1", "2", "3"}, []string{"3"}},
+		{"empty window", [][]GuildStashEntry{entries}, 3000, 4000, []string{"1", "2", "3"}, nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			archive := testArchive(t)
+			var added []string
+			for _, entries := range test.appends {
+				appended, err := archive.Append(entries)
+				if err != nil {
+					t.Fatal(err)
+				}
+				added = append(added, entryIds(appended)...)
+			}
+			slices.Sort(added)
+			if !slices.Equal(added, test.wantAdded) {
+				t.Errorf("added %v, want %v", added, test.wantAdded)
+			}
+
+			// A reopened archive has to know the same entries
+			reopened, err := OpenStashArchive(1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, id := range test.wantAdded {
+				if !reopened.Has(id) {
+					t.Errorf("reopened archive is missing entry %s", id)
+				}
+			}
+			if earliest, latest, ok := reopened.Bounds(); earliest != 1000 || latest != 2000+day || !ok {
+				t.Errorf("Bounds() = %d, %d, %v, want 1000, %d, true", earliest, latest, ok, 2000+day)
+			}
+			got, err := reopened.Entries(test.start, test.end)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ids := entryIds(got); !slices.Equal(ids, test.wantEntries) {
+				t.Errorf("Entries(%d, %d) = %v, want %v", test.start, test.end, ids, test.wantEntries)
+			}
+		})
+	}
+}
+
+func TestArchiveCursor(t *testing.T) {
+	tests := []struct {
+		name   string
+		saved  *ArchiveCursor
+		clear  bool
+		wantOk bool
+	}{
+		{"no walk", nil, false, false},
+		{"unfinished walk", &ArchiveCursor{End: 100, FromId: "abc", Time: 500}, false, true},
+		{"finished walk", &ArchiveCursor{End: 100, FromId: "abc", Time: 500}, true, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			archive := testArchive(t)
+			if test.saved != nil {
+				if err := archive.SaveCursor(test.saved); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if test.clear {
+				if err := archive.ClearCursor(); err != nil {
+					t.Fatal(err)
+				}
+			}
+			cursor, err := archive.Cursor()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if (cursor != nil) != test.wantOk {
+				t.Fatalf("Cursor() = %v, want one %v", cursor, test.wantOk)
+			}
+			if cursor != nil && (cursor.End != test.saved.End || cursor.FromId != test.saved.FromId || cursor.Time != test.saved.Time) {
+				t.Errorf("Cursor() = %+v, want %+v", cursor, test.saved)
+			}
+		})
+	}
+}
+
+func TestWalkCheckpointKinds(t *testing.T) {
+	kinds := []walkKind{monitorWalk, backfillWalk, verifyWalk}
+	tests := []struct {
+		name  string
+		saved walkKind
+		// cleared is the kind whose checkpoint is cleared after saving, if clear is set
+		clear   bool
+		cleared walkKind
+	}{
+		{"monitor", monitorWalk, false, ""},
+		{"backfill", backfillWalk, false, ""},
+		{"backfill cleared by the monitor", backfillWalk, true, monitorWalk},
+		{"monitor cleared by a backfill", monitorWalk, true, backfillWalk},
+		{"backfill cleared", backfillWalk, true, backfillWalk},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			archive := testArchive(t)
+			saved := &WalkCheckpoint{Start: 200, End: 100, Segments: splitWalk(200, 100, 0)}
+			if err := archive.SaveWalkCheckpoint(test.saved, saved); err != nil {
+				t.Fatal(err)
+			}
+			if test.clear {
+				if err := archive.ClearWalkCheckpoint(test.cleared); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for _, kind := range kinds {
+				checkpoint, err := archive.WalkCheckpoint(kind)
+				if err != nil {
+					t.Fatal(err)
+				}
+				want := kind == test.saved && (!test.clear || test.cleared != kind)
+				if (checkpoint != nil) != want {
+					t.Errorf("checkpoint of walk %q = %v, want one %v", kind, checkpoint, want)
+					continue
+				}
+				if checkpoint != nil && !slices.Equal(checkpoint.Segments, saved.Segments) {
+					t.Errorf("checkpoint of walk %q has segments %v, want %v", kind, checkpoint.Segments, saved.Segments)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,117 @@
+package guild_stash_logs
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// timeLayouts are the absolute time formats accepted for backfill windows, in local time
+var timeLayouts = []string{
+	time.RFC3339,
+	"2006-01-02 15:04:05",
+	"2006-01-02 15:04",
+	"2006-01-02T15:04",
+	"2006-01-02",
+}
+
+// parseDuration parses a Go duration with additional support for days, e.g. "2d" or "1d12h"
+func parseDuration(value string) (time.Duration, error) {
+	var days time.Duration
+	if before, after, found := strings.Cut(value, "d"); found {
+		n, err := strconv.Atoi(before)
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration %q", value)
+		}
+		days = time.Duration(n) * 24 * time.Hour
+		if after == "" {
+			return days, nil
+		}
+		value = after
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid duration %q", value)
+	}
+	return days + d, nil
+}
+
+// ParseTime parses an absolute time like "2025-06-01 12:00" or a time relative to now like
+// "6h ago" or "now"
+func ParseTime(value string, now time.Time) (time.Time, error) {
+	value = strings.TrimSpace(value)
+	if value == "" || strings.EqualFold(value, "now") {
+		return now, nil
+	}
+	if ago, found := strings.CutSuffix(value, " ago"); found {
+		d, err := parseDuration(strings.TrimSpace(ago))
+		if err != nil {
+			return time.Time{}, err
+		}
+		return now.Add(-d), nil
+	}
+	for _, layout := range timeLayouts {
+		if t, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q, expected e.g. \"2025-06-01 12:00\", \"6h ago\" or \"now\"", value)
+}
+
+// ParseTimeWindow parses the start and end of a window. The end defaults to now, and the start
+// may also be relative to the end, e.g. "last 6h" or "last 2d".
+func ParseTimeWindow(start, end string, now time.Time) (time.Time, time.Time, error) {
+	endTime, err := ParseTime(end, now)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	var startTime time.Time
+	if last, found := strings.CutPrefix(strings.TrimSpace(start), "last "); found {
+		d, err := parseDuration(strings.TrimSpace(last))
+		if err != nil {
+			return time.Time{}, time.Time{}, err
+		}
+		startTime = endTime.Add(-d)
+	} else if startTime, err = ParseTime(start, now); err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	if !startTime.Before(endTime) {
+		return time.Time{}, time.Time{}, fmt.Errorf("the start %s is not before the end %s", startTime.Format("2006-01-02 15:04"), endTime.Format("2006-01-02 15:04"))
+	}
+	return startTime, endTime, nil
+}
+
+// RunBackfill fetches the stash history between start and end again, no matter what the
+// backend reports to have. Entries that were uploaded before are skipped unless
+// options.ForceResend is set. The walk is checkpointed apart from the monitor's, so an
+// interrupted walk of the monitor stays for the monitor to resume, and a backfill of the same
+// window continues the segments an interrupted backfill didn't finish.
+func RunBackfill(sessionId, bplJwt string, options Options, start, end time.Time) error {
+	ctx := context.Background()
+	client, err := NewClient(sessionId, bplJwt, options)
+	if err != nil {
+		return fmt.Errorf("error creating client: %w", err)
+	}
+	stopUploads := client.sink.Start()
+	defer stopUploads()
+
+	var added int
+	client.onNewEntries = func(entries []GuildStashEntry) {
+		added += len(entries)
+	}
+	client.walkKind = backfillWalk
+	client.leagueStart, client.leagueEnd = start.Unix(), end.Unix()
+	if err := client.getHistorySegmented(ctx, end.Unix(), start.Unix()); err != nil {
+		return fmt.Errorf("error getting history: %w", err)
+	}
+	client.notify("Fetched %d entries, %d of them were not in the local archive yet", client.walkEntries, added)
+
+	client.notify("Waiting for stash history uploads to finish...")
+	if err := client.sink.Flush(5 * time.Minute); err != nil {
+		return fmt.Errorf("error uploading history: %w", err)
+	}
+	client.notify("Backfill completed successfully")
+	return nil
+}
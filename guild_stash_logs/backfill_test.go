@@ -0,0 +1,107 @@
+package guild_stash_logs
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseDuration(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    time.Duration
+		wantErr bool
+	}{
+		{"6h", 6 * time.Hour, false},
+		{"90m", 90 * time.Minute, false},
+		{"1h30m", 90 * time.Minute, false},
+		{"2d", 48 * time.Hour, false},
+		{"1d12h", 36 * time.Hour, false},
+		{"0d30m", 30 * time.Minute, false},
+		{"", 0, true},
+		{"d", 0, true},
+		{"xd", 0, true},
+		{"2d12", 0, true},
+		{"soon", 0, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.value, func(t *testing.T) {
+			got, err := parseDuration(test.value)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("parseDuration(%q) error = %v, want error %v", test.value, err, test.wantErr)
+			}
+			if got != test.want {
+				t.Errorf("parseDuration(%q) = %v, want %v", test.value, got, test.want)
+			}
+		})
+	}
+}
+
+func TestParseTime(t *testing.T) {
+	now := time.Date(2025, 6, 10, 18, 30, 0, 0, time.Local)
+	tests := []struct {
+		value   string
+		want    time.Time
+		wantErr bool
+	}{
+		{"", now, false},
+		{"now", now, false},
+		{" NOW ", now, false},
+		{"6h ago", now.Add(-6 * time.Hour), false},
+		{"2d ago", now.Add(-48 * time.Hour), false},
+		{"1d12h ago", now.Add(-36 * time.Hour), false},
+		{"2025-06-01T12:00:00Z", time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC), false},
+		{"2025-06-01 12:00:30", time.Date(2025, 6, 1, 12, 0, 30, 0, time.Local), false},
+		{"2025-06-01 12:00", time.Date(2025, 6, 1, 12, 0, 0, 0, time.Local), false},
+		{"2025-06-01T12:00", time.Date(2025, 6, 1, 12, 0, 0, 0, time.Local), false},
+		{"2025-06-01", time.Date(2025, 6, 1, 0, 0, 0, 0, time.Local), false},
+		{"yesterday", time.Time{}, true},
+		{"6x ago", time.Time{}, true},
+		{"2025-13-01", time.Time{}, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.value, func(t *testing.T) {
+			got, err := ParseTime(test.value, now)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("ParseTime(%q) error = %v, want error %v", test.value, err, test.wantErr)
+			}
+			if !got.Equal(test.want) {
+				t.Errorf("ParseTime(%q) = %v, want %v", test.value, got, test.want)
+			}
+		})
+	}
+}
+
+func TestParseTimeWindow(t *testing.T) {
+	now := time.Date(2025, 6, 10, 18, 30, 0, 0, time.Local)
+	tests := []struct {
+		name      string
+		start     string
+		end       string
+		wantStart time.Time
+		wantEnd   time.Time
+		wantErr   bool
+	}{
+		{"relative to now", "last 6h", "", now.Add(-6 * time.Hour), now, false},
+		{"relative to the end", "last 2d", "2025-06-05", time.Date(2025, 6, 3, 0, 0, 0, 0, time.Local), time.Date(2025, 6, 5, 0, 0, 0, 0, time.Local), false},
+		{"ago until now", "12h ago", "now", now.Add(-12 * time.Hour), now, false},
+		{"absolute", "2025-06-01 12:00", "2025-06-02", time.Date(2025, 6, 1, 12, 0, 0, 0, time.Local), time.Date(2025, 6, 2, 0, 0, 0, 0, time.Local), false},
+		{"start after end", "2025-06-02", "2025-06-01", time.Time{}, time.Time{}, true},
+		{"empty window", "now", "now", time.Time{}, time.Time{}, true},
+		{"invalid start", "last week", "", time.Time{}, time.Time{}, true},
+		{"invalid end", "last 6h", "tomorrow", time.Time{}, time.Time{}, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			start, end, err := ParseTimeWindow(test.start, test.end, now)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("ParseTimeWindow(%q, %q) error = %v, want error %v", test.start, test.end, err, test.wantErr)
+			}
+			if !start.Equal(test.wantStart) || !end.Equal(test.wantEnd) {
+				t.Errorf("ParseTimeWindow(%q, %q) = %v, %v, want %v, %v", test.start, test.end, start, end, test.wantStart, test.wantEnd)
+			}
+		})
+	}
+}
@@ -0,0 +1,203 @@
+package guild_stash_logs
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"time"
+)
+
+// CoverageOptions configures how gaps in the stash history are detected
+type CoverageOptions struct {
+	// BucketSize is the length of the time buckets entries are counted in
+	BucketSize time.Duration
+	// Neighbours is the number of non-empty buckets on each side a bucket is compared to
+	Neighbours int
+	// MinActivity is the median entry count around a bucket below which it isn't checked,
+	// so quiet hours don't show up as gaps
+	MinActivity int
+	// DropRatio flags buckets with at most this fraction of the median entry count around them
+	DropRatio float64
+}
+
+// CoverageBucket is the number of archived entries between Start (inclusive) and End (exclusive)
+type CoverageBucket struct {
+	Start   int64
+	End     int64
+	Entries int
+}
+
+// CoverageGap is a window that is probably missing stash history
+type CoverageGap struct {
+	Start    int64
+	End      int64
+	Entries  int
+	Expected float64
+	Reason   string
+}
+
+func (g CoverageGap) String() string {
+	return fmt.Sprintf("%s - %s: %s", time.Unix(g.Start, 0).Format("2006-01-02 15:04"), time.Unix(g.End, 0).Format("2006-01-02 15:04"), g.Reason)
+}
+
+// Coverage counts the archived entries per bucket between start and end
+func (a *StashArchive) Coverage(start, end int64, bucketSize time.Duration) ([]CoverageBucket, error) {
+	size := int64(bucketSize.Seconds())
+	if size <= 0 {
+		return nil, fmt.Errorf("invalid bucket size %v", bucketSize)
+	}
+	entries, err := a.Entries(start, end)
+	if err != nil {
+		return nil, err
+	}
+	var buckets []CoverageBucket
+	for bucketStart := start; bucketStart < end; bucketStart += size {
+		buckets = append(buckets, CoverageBucket{Start: bucketStart, End: min(bucketStart+size, end)})
+	}
+	for _, entry := range entries {
+		if index := (entry.Time - start) / size; index < int64(len(buckets)) {
+			buckets[index].Entries++
+		}
+	}
+	return buckets, nil
+}
+
+// FindCoverageGaps returns the windows whose entry count dropped sharply compared to the
+// buckets around them. Neighbouring suspicious buckets are merged into one gap.
+func FindCoverageGaps(buckets []CoverageBucket, options CoverageOptions) []CoverageGap {
+	var gaps []CoverageGap
+	for i, bucket := range buckets {
+		expected := neighbourMedian(buckets, i, options.Neighbours)
+		if expected < float64(options.MinActivity) || float64(bucket.Entries) > expected*options.DropRatio {
+			continue
+		}
+		if n := len(gaps); n > 0 && gaps[n-1].End == bucket.Start {
+			gaps[n-1].End = bucket.End
+			gaps[n-1].Entries += bucket.Entries
+			gaps[n-1].Expected += expected
+			gaps[n-1].Reason = fmt.Sprintf("%d entries, expected about %.0f", gaps[n-1].Entries, gaps[n-1].Expected)
+			continue
+		}
+		gaps = append(gaps, CoverageGap{
+			Start:    bucket.Start,
+			End:      bucket.End,
+			Entries:  bucket.Entries,
+			Expected: expected,
+			Reason:   fmt.Sprintf("%d entries, expected about %.0f", bucket.Entries, expected),
+		})
+	}
+	return gaps
+}
+
+// neighbourMedian returns the median entry count of the nearest non-empty buckets on each side
+// of index. Empty buckets are skipped instead of counted, so the buckets in the middle of a long
+// outage are still compared to the activity before and after it.
+func neighbourMedian(buckets []CoverageBucket, index, neighbours int) float64 {
+	var counts []int
+	found := 0
+	for i := index - 1; i >= 0 && found < neighbours; i-- {
+		if buckets[i].Entries > 0 {
+			counts = append(counts, buckets[i].Entries)
+			found++
+		}
+	}
+	found = 0
+	for i := index + 1; i < len(buckets) && found < neighbours; i++ {
+		if buckets[i].Entries > 0 {
+			counts = append(counts, buckets[i].Entries)
+			found++
+		}
+	}
+	if len(counts) == 0 {
+		return 0
+	}
+	slices.Sort(counts)
+	middle := len(counts) / 2
+	if len(counts)%2 == 0 {
+		return float64(counts[middle-1]+counts[middle]) / 2
+	}
+	return float64(counts[middle])
+}
+
+// backendGaps returns the parts of the archive that lie outside of what the backend reports to have
+func backendGaps(timestamps *GuildStashLogTimestampResponse, earliest, latest int64) []CoverageGap {
+	if timestamps.Earliest == nil || timestamps.Latest == nil {
+		return []CoverageGap{{Start: earliest, End: latest, Reason: "the backend has no entries at all"}}
+	}
+	var gaps []CoverageGap
+	if earliest < *timestamps.Earliest {
+		gaps = append(gaps, CoverageGap{Start: earliest, End: *timestamps.Earliest, Reason: "older than the earliest entry in the backend"})
+	}
+	if latest > *timestamps.Latest {
+		gaps = append(gaps, CoverageGap{Start: *timestamps.Latest, End: latest, Reason: "newer than the latest entry in the backend"})
+	}
+	return gaps
+}
+
+// RunCoverageVerification checks the local archive for gaps in the stash history, both in
+// itself and compared to what the backend has. Archived entries the backend is missing are
+// uploaded from the archive, only the holes in the archive are fetched from PoE again.
+func RunCoverageVerification(sessionId, bplJwt string, options Options) error {
+	ctx := context.Background()
+	client, err := NewClient(sessionId, bplJwt, options)
+	if err != nil {
+		return fmt.Errorf("error creating client: %w", err)
+	}
+	// The re-fetched windows must not replace the cursor the monitor resumes from
+	client.walkKind = verifyWalk
+	timestamps, err := client.getTimestamps()
+	if err != nil {
+		return fmt.Errorf("error getting timestamps: %w", err)
+	}
+	earliest, latest, ok := client.archive.Bounds()
+	if !ok {
+		return fmt.Errorf("the local stash archive is empty, run the Guild Stash Monitor once before verifying coverage")
+	}
+	stopUploads := client.sink.Start()
+	defer stopUploads()
+
+	buckets, err := client.archive.Coverage(max(earliest, timestamps.LeagueStart), latest+1, options.Coverage.BucketSize)
+	if err != nil {
+		return fmt.Errorf("error reading archive: %w", err)
+	}
+	backend := backendGaps(timestamps, earliest, latest)
+	gaps := FindCoverageGaps(buckets, options.Coverage)
+	if len(backend) == 0 && len(gaps) == 0 {
+		client.notify("No gaps found in %d buckets of %v", len(buckets), options.Coverage.BucketSize)
+		return nil
+	}
+
+	client.notify("Found %d suspicious windows:", len(backend)+len(gaps))
+	for _, gap := range slices.Concat(backend, gaps) {
+		client.notify("  %s", gap)
+	}
+	// The archive already has the entries the backend is missing
+	for _, gap := range backend {
+		if err := client.queueArchive(gap.Start, gap.End); err != nil {
+			return fmt.Errorf("error queueing archived %s: %w", gap, err)
+		}
+		client.notify("Queued the archived entries of %s for upload", gap)
+	}
+	for _, gap := range gaps {
+		before, err := client.archive.Entries(gap.Start, gap.End)
+		if err != nil {
+			return fmt.Errorf("error reading archive: %w", err)
+		}
+		client.leagueStart, client.leagueEnd = gap.Start, gap.End
+		if _, _, err := client.getHistoryBetween(ctx, gap.End, gap.Start, ""); err != nil {
+			return fmt.Errorf("error re-fetching %s: %w", gap, err)
+		}
+		after, err := client.archive.Entries(gap.Start, gap.End)
+		if err != nil {
+			return fmt.Errorf("error reading archive: %w", err)
+		}
+		client.notify("Re-fetched %s, recovered %d entries", gap, len(after)-len(before))
+	}
+
+	client.notify("Waiting for stash history uploads to finish...")
+	if err := client.sink.Flush(5 * time.Minute); err != nil {
+		return err
+	}
+	client.notify("Coverage verification completed successfully")
+	return nil
+}
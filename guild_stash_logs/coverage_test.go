@@ -0,0 +1,50 @@
+package guild_stash_logs
+
+import (
+	"slices"
+	"testing"
+)
+
+// hourlyBuckets returns one hour long buckets starting at 0 with the given entry counts
+func hourlyBuckets(counts ...int) []CoverageBucket {
+	buckets := make([]CoverageBucket, len(counts))
+	for i, count := range counts {
+		buckets[i] = CoverageBucket{Start: int64(i) * 3600, End: int64(i+1) * 3600, Entries: count}
+	}
+	return buckets
+}
+
+// repeat returns count copies of value
+func repeat(value, count int) []int {
+	return slices.Repeat([]int{value}, count)
+}
+
+func TestFindCoverageGaps(t *testing.T) {
+	options := CoverageOptions{Neighbours: 3, MinActivity: 10, DropRatio: 0.1}
+	tests := []struct {
+		name   string
+		counts []int
+		// want are the flagged windows as [first bucket, last bucket + 1]
+		want [][2]int
+	}{
+		{"steady activity", repeat(50, 48), nil},
+		{"single bucket drop", slices.Concat(repeat(50, 10), []int{2}, repeat(50, 10)), [][2]int{{10, 11}}},
+		{"small dip", slices.Concat(repeat(50, 10), []int{20}, repeat(50, 10)), nil},
+		{"two empty buckets", slices.Concat(repeat(50, 10), repeat(0, 2), repeat(50, 10)), [][2]int{{10, 12}}},
+		{"24h outage", slices.Concat(repeat(50, 24), repeat(0, 24), repeat(50, 24)), [][2]int{{24, 48}}},
+		{"outage next to a drop", slices.Concat(repeat(50, 24), []int{3}, repeat(0, 23), repeat(50, 24)), [][2]int{{24, 48}}},
+		{"quiet period", slices.Concat(repeat(4, 10), repeat(0, 5), repeat(4, 10)), nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var got [][2]int
+			for _, gap := range FindCoverageGaps(hourlyBuckets(test.counts...), options) {
+				got = append(got, [2]int{int(gap.Start / 3600), int(gap.End / 3600)})
+			}
+			if !slices.Equal(got, test.want) {
+				t.Errorf("FindCoverageGaps() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
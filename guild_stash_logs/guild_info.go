@@ -1,11 +1,12 @@
 package guild_stash_logs
 
 import (
+	"errors"
 	"fmt"
-	htmlutil "html"
 	"io"
 	"net/http"
 	"regexp"
+	"slices"
 	"strconv"
 	"strings"
 
@@ -19,17 +20,50 @@ type GuildInfo struct {
 	Tag  string `json:"tag"`
 }
 
+// ErrGuildMismatch is returned when a session belongs to a different guild than configured
+var ErrGuildMismatch = errors.New("session belongs to a different guild")
+
+// ErrNotInGuild is returned when the account of the session is not a member of any guild
+var ErrNotInGuild = errors.New("the POESESSID account is not a member of a guild")
+
+// ErrGuildPageChanged is returned when the guild page can't be understood, most likely because
+// PoE changed its layout
+var ErrGuildPageChanged = errors.New("unexpected guild page, the PoE website layout may have changed")
+
+// CheckId returns an error if this is not the guild with the expected id. An expected id of 0 accepts any guild.
+func (g *GuildInfo) CheckId(expectedId int) error {
+	if expectedId == 0 || g.Id == expectedId {
+		return nil
+	}
+	return fmt.Errorf("%w: the POESESSID is a member of %s <%s> (guild %d), but GUILD_ID is %d. Log in with an account in guild %d or update GUILD_ID",
+		ErrGuildMismatch, g.Name, g.Tag, g.Id, expectedId, expectedId)
+}
+
 // FetchGuildInfo fetches and parses guild information from the PoE website
 func FetchGuildInfo(sessionID string) (*GuildInfo, error) {
-	url := "https://www.pathofexile.com/my-guild"
+	body, err := fetchPoePage(poeBaseUrl+"/my-guild", sessionID)
+	if err != nil {
+		return nil, err
+	}
 
+	// Parse HTML and extract guild info
+	guildInfo, err := parseGuildInfo(body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse guild info: %w", err)
+	}
+
+	return guildInfo, nil
+}
+
+// fetchPoePage fetches a page of the PoE website as the account of the session
+func fetchPoePage(url, sessionID string) (string, error) {
 	// Create HTTP client
 	client := &http.Client{}
 
 	// Create request
 	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create request: %w", err)
+		return "", fmt.Errorf("failed to create request: %w", err)
 	}
 
 	// Add headers to mimic browser request
@@ -38,30 +72,55 @@ func FetchGuildInfo(sessionID string) (*GuildInfo, error) {
 	// Make request
 	resp, err := client.Do(req)
 	if err != nil {
-		return nil, fmt.Errorf("failed to make request: %w", err)
+		return "", fmt.Errorf("failed to make request: %w", err)
 	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+		return "", NewCredentialError("poe_session", fmt.Sprintf("HttpStatusCode: %d (PoE Session ID most likely invalid)", resp.StatusCode), resp.StatusCode)
+	}
 	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+		return "", fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+	// PoE redirects expired sessions to the login page
+	if strings.HasPrefix(resp.Request.URL.Path, "/login") {
+		return "", NewCredentialError("poe_session", "PoE redirected to the login page (PoE Session ID most likely invalid or expired)", http.StatusUnauthorized)
 	}
 
 	// Read response body
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read response body: %w", err)
+		return "", fmt.Errorf("failed to read response body: %w", err)
 	}
+	return string(body), nil
+}
 
-	// Parse HTML and extract guild info
-	guildInfo, err := parseGuildInfo(string(body))
-	if err != nil {
-		return nil, fmt.Errorf("failed to parse guild info: %w", err)
-	}
+var (
+	guildIdRegex = regexp.MustCompile(`/guild/profile/(\d+)`)
+	// notInGuildRegex matches the notice PoE shows instead of the guild page to accounts without a guild
+	notInGuildRegex = regexp.MustCompile(`(?i)not (currently )?(in|a member of) a guild|(join|create) a guild`)
+)
 
-	return guildInfo, nil
+// hasClass reports whether the class attribute of n contains the given class
+func hasClass(n *html.Node, class string) bool {
+	return slices.Contains(strings.Fields(attribute(n, "class")), class)
 }
 
-// parseGuildInfo extracts guild information from HTML content
+// isLoginForm reports whether n is the login form or one of its inputs
+func isLoginForm(n *html.Node) bool {
+	switch n.Data {
+	case "form":
+		return strings.Contains(strings.ToLower(attribute(n, "action")), "/login")
+	case "input":
+		name := attribute(n, "name")
+		return name == "login_email" || name == "login_password" || attribute(n, "type") == "password"
+	}
+	return false
+}
+
+// parseGuildInfo extracts guild information from HTML content. It returns a CredentialError for
+// the login page, ErrNotInGuild if the account has no guild and ErrGuildPageChanged if the page
+// can't be understood.
 func parseGuildInfo(htmlContent string) (*GuildInfo, error) {
 	doc, err := html.Parse(strings.NewReader(htmlContent))
 	if err != nil {
@@ -71,8 +130,7 @@ func parseGuildInfo(htmlContent string) (*GuildInfo, error) {
 	guildInfo := &GuildInfo{}
 
 	// Extract guild ID from tab links (e.g., /guild/profile/408208)
-	guildIDRegex := regexp.MustCompile(`/guild/profile/(\d+)`)
-	matches := guildIDRegex.FindStringSubmatch(htmlContent)
+	matches := guildIdRegex.FindStringSubmatch(htmlContent)
 	if len(matches) > 1 {
 		guildInfo.Id, err = strconv.Atoi(matches[1])
 		if err != nil {
@@ -81,33 +139,22 @@ func parseGuildInfo(htmlContent string) (*GuildInfo, error) {
 	}
 
 	// Extract guild name and tag using HTML parsing
+	loginPage := false
 	var walkHTML func(*html.Node)
 	walkHTML = func(n *html.Node) {
 		if n.Type == html.ElementNode {
 			// Look for guild name in h1 with class "name"
-			if n.Data == "h1" {
-				for _, attr := range n.Attr {
-					if attr.Key == "class" && attr.Val == "name" {
-						if n.FirstChild != nil && n.FirstChild.Type == html.TextNode {
-							guildInfo.Name = strings.TrimSpace(n.FirstChild.Data)
-						}
-					}
-				}
+			if n.Data == "h1" && hasClass(n, "name") && guildInfo.Name == "" {
+				guildInfo.Name = strings.Join(strings.Fields(textContent(n)), " ")
 			}
 
-			// Look for guild tag in p with class "guild-tag"
-			if n.Data == "p" {
-				for _, attr := range n.Attr {
-					if attr.Key == "class" && attr.Val == "guild-tag" {
-						if n.FirstChild != nil && n.FirstChild.Type == html.TextNode {
-							tag := strings.TrimSpace(n.FirstChild.Data)
-							// Decode HTML entities and remove surrounding brackets
-							tag = htmlutil.UnescapeString(tag)
-							tag = strings.Trim(tag, "<>")
-							guildInfo.Tag = tag
-						}
-					}
-				}
+			// Look for guild tag in an element with class "guild-tag", shown as "<TAG>"
+			if hasClass(n, "guild-tag") && guildInfo.Tag == "" {
+				guildInfo.Tag = strings.Trim(strings.TrimSpace(textContent(n)), "<>")
+			}
+
+			if isLoginForm(n) {
+				loginPage = true
 			}
 		}
 
@@ -119,18 +166,26 @@ func parseGuildInfo(htmlContent string) (*GuildInfo, error) {
 
 	walkHTML(doc)
 
-	// Validate that we found the required information
-	if guildInfo.Name == "" {
-		return nil, fmt.Errorf("guild name not found in HTML")
+	if guildInfo.Name != "" && guildInfo.Tag != "" && guildInfo.Id != 0 {
+		return guildInfo, nil
+	}
+	// An expired session doesn't fail, PoE just serves the login page instead
+	if loginPage {
+		return nil, NewCredentialError("poe_session", "PoE shows the login page instead of the guild page (PoE Session ID most likely invalid or expired)", http.StatusUnauthorized)
+	}
+	if guildInfo.Name == "" && guildInfo.Id == 0 && notInGuildRegex.MatchString(textContent(doc)) {
+		return nil, ErrNotInGuild
 	}
 
+	var missing []string
+	if guildInfo.Name == "" {
+		missing = append(missing, "guild name")
+	}
 	if guildInfo.Tag == "" {
-		return nil, fmt.Errorf("guild tag not found in HTML")
+		missing = append(missing, "guild tag")
 	}
-
 	if guildInfo.Id == 0 {
-		return nil, fmt.Errorf("guild ID not found in HTML")
+		missing = append(missing, "guild ID")
 	}
-
-	return guildInfo, nil
+	return nil, fmt.Errorf("%w: %s not found in HTML", ErrGuildPageChanged, strings.Join(missing, ", "))
 }
@@ -0,0 +1,49 @@
+package guild_stash_logs
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseGuildInfo(t *testing.T) {
+	tests := []struct {
+		fixture string
+		want    *GuildInfo
+		// wantErr is checked with errors.Is, except for credential errors
+		wantErr       error
+		wantCredError bool
+	}{
+		{fixture: "guild.html", want: &GuildInfo{Id: 408208, Name: "Exiles of Wraeclast", Tag: "EXILE"}},
+		{fixture: "guild_multiple_classes.html", want: &GuildInfo{Id: 408208, Name: "Exiles of Wraeclast", Tag: "EXILE"}},
+		{fixture: "login.html", wantCredError: true},
+		{fixture: "not_in_guild.html", wantErr: ErrNotInGuild},
+		{fixture: "layout_changed.html", wantErr: ErrGuildPageChanged},
+	}
+
+	for _, test := range tests {
+		t.Run(test.fixture, func(t *testing.T) {
+			content, err := os.ReadFile(filepath.Join("testdata", "guild_info", test.fixture))
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := parseGuildInfo(string(content))
+			var credErr *CredentialError
+			switch {
+			case test.wantCredError:
+				if !errors.As(err, &credErr) || credErr.Type != "poe_session" {
+					t.Errorf("parseGuildInfo() error = %v, want a poe_session CredentialError", err)
+				}
+			case test.wantErr != nil:
+				if !errors.Is(err, test.wantErr) {
+					t.Errorf("parseGuildInfo() error = %v, want %v", err, test.wantErr)
+				}
+			case err != nil:
+				t.Errorf("parseGuildInfo() error = %v", err)
+			case *got != *test.want:
+				t.Errorf("parseGuildInfo() = %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,246 @@
+package guild_stash_logs
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"tools/league_invites"
+
+	"golang.org/x/net/html"
+)
+
+// GuildMember is one member of a guild as listed on the guild profile page
+type GuildMember struct {
+	AccountName string `json:"account_name"`
+	Rank        string `json:"rank"`
+	// NotOnTeam is set for members that are not signed up for the team that owns the guild
+	NotOnTeam bool `json:"not_on_team"`
+}
+
+var profileLinkRegex = regexp.MustCompile(`^/account/view-profile/([^/?#]+)`)
+
+// knownRanks are the guild ranks PoE shows next to the members
+var knownRanks = []string{"Leader", "Officer", "Member", "Recruit"}
+
+// FetchGuildRoster fetches the member list of a guild from its profile page
+func FetchGuildRoster(sessionID string, guildId int) ([]GuildMember, error) {
+	body, err := fetchPoePage(fmt.Sprintf("%s/guild/profile/%d", poeBaseUrl, guildId), sessionID)
+	if err != nil {
+		return nil, err
+	}
+	members, err := parseGuildRoster(body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse guild roster: %w", err)
+	}
+	return members, nil
+}
+
+// parseGuildRoster extracts the account names and ranks from a guild profile page. Every
+// link to an account profile is a member, the rank is looked up in the row around the link.
+func parseGuildRoster(htmlContent string) ([]GuildMember, error) {
+	doc, err := html.Parse(strings.NewReader(htmlContent))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse HTML: %w", err)
+	}
+
+	var members []GuildMember
+	seen := make(map[string]bool)
+	var walkHTML func(*html.Node)
+	walkHTML = func(n *html.Node) {
+		if n.Type == html.ElementNode && n.Data == "a" {
+			if matches := profileLinkRegex.FindStringSubmatch(attribute(n, "href")); matches != nil {
+				name, err := url.PathUnescape(matches[1])
+				if err == nil && !seen[name] {
+					seen[name] = true
+					members = append(members, GuildMember{AccountName: name, Rank: findRank(memberRow(n))})
+				}
+			}
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walkHTML(c)
+		}
+	}
+	walkHTML(doc)
+
+	if len(members) == 0 {
+		return nil, fmt.Errorf("no guild members found in HTML")
+	}
+	return members, nil
+}
+
+func attribute(n *html.Node, key string) string {
+	for _, attr := range n.Attr {
+		if attr.Key == key {
+			return attr.Val
+		}
+	}
+	return ""
+}
+
+// memberRow returns the closest table row or "member" element around a profile link
+func memberRow(n *html.Node) *html.Node {
+	for parent := n.Parent; parent != nil; parent = parent.Parent {
+		if parent.Type != html.ElementNode {
+			continue
+		}
+		if parent.Data == "tr" || parent.Data == "li" || strings.Contains(strings.ToLower(attribute(parent, "class")), "member") {
+			return parent
+		}
+	}
+	return n
+}
+
+// findRank prefers an element with "rank" or "type" in its class and falls back to a known rank name
+func findRank(row *html.Node) string {
+	var byClass, byName string
+	var walk func(*html.Node)
+	walk = func(n *html.Node) {
+		if n.Type == html.ElementNode && n.Data != "a" {
+			class := strings.ToLower(attribute(n, "class"))
+			if byClass == "" && (strings.Contains(class, "rank") || strings.Contains(class, "type")) {
+				byClass = strings.TrimSpace(textContent(n))
+			}
+		}
+		if n.Type == html.TextNode && byName == "" {
+			text := strings.TrimSpace(n.Data)
+			for _, rank := range knownRanks {
+				if strings.EqualFold(text, rank) || strings.EqualFold(text, "Guild "+rank) {
+					byName = rank
+				}
+			}
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	walk(row)
+	if byClass != "" {
+		return byClass
+	}
+	return byName
+}
+
+func textContent(n *html.Node) string {
+	if n.Type == html.TextNode {
+		return n.Data
+	}
+	var text strings.Builder
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		text.WriteString(textContent(c))
+	}
+	return text.String()
+}
+
+// normalizeAccountName makes account names from the PoE website and the BPL backend comparable.
+// Profile URLs use "Name-1234" for the discriminator where the API uses "Name#1234".
+func normalizeAccountName(name string) string {
+	return strings.ToLower(strings.ReplaceAll(name, "#", "-"))
+}
+
+// flagMembersNotOnTeam marks every member that is not signed up for the team owning the guild.
+// The owning team is the team most of the signed up members are on. Returns the resolver of
+// the signups, its OwningTeam is nil if no member is signed up for any team.
+func flagMembersNotOnTeam(members []GuildMember, signups []league_invites.Player) *TeamResolver {
+	resolver := NewTeamResolver(signups, members)
+	for i, member := range members {
+		members[i].NotOnTeam = resolver.OwningTeam == nil || resolver.IsOutsider(member.AccountName)
+	}
+	return resolver
+}
+
+// pluralityTeam returns the team most members are on, with teams keyed by normalized account
+// name. Ties go to the lower team id. Returns nil if no member is on any team.
+func pluralityTeam(members []GuildMember, teams map[string]int) *int {
+	counts := make(map[int]int)
+	for _, member := range members {
+		if team, ok := teams[normalizeAccountName(member.AccountName)]; ok {
+			counts[team]++
+		}
+	}
+	var owningTeam *int
+	for team, count := range counts {
+		if owningTeam == nil || count > counts[*owningTeam] || (count == counts[*owningTeam] && team < *owningTeam) {
+			owningTeam = &team
+		}
+	}
+	return owningTeam
+}
+
+// syncRoster scrapes the guild's members, flags the ones not on the owning team and sends
+// the roster to the BPL backend. Members that are not on the team are printed as a warning.
+func (c *Client) syncRoster() error {
+	members, err := FetchGuildRoster(c.SessionId, c.GuildId)
+	if err != nil {
+		return err
+	}
+	signups, err := c.fetchSignups()
+	if err != nil {
+		return err
+	}
+	c.teams = flagMembersNotOnTeam(members, signups)
+
+	for _, member := range members {
+		if member.NotOnTeam {
+			c.notify("Warning: guild member %s (%s) is not signed up for the team that owns this guild", member.AccountName, member.Rank)
+		}
+	}
+	return c.registerRoster(members)
+}
+
+// fetchSignups fetches the players signed up for the current event
+func (c *Client) fetchSignups() ([]league_invites.Player, error) {
+	signups, err := league_invites.FetchSignups(bplBaseUrl, c.BplJwt)
+	var signupCredErr *league_invites.CredentialError
+	if errors.As(err, &signupCredErr) {
+		return nil, NewCredentialError(signupCredErr.Type, signupCredErr.Message, signupCredErr.Code)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch signups: %w", err)
+	}
+	return signups, nil
+}
+
+// trySyncRoster syncs the roster when monitoring starts. The roster is extra information,
+// so only bad credentials are returned, other errors are just a warning.
+func (c *Client) trySyncRoster() error {
+	err := c.syncRoster()
+	var credErr *CredentialError
+	if errors.As(err, &credErr) {
+		return err
+	}
+	if err != nil {
+		c.notify("Warning: Could not sync guild roster: %v", err)
+	}
+	return nil
+}
+
+func (c *Client) registerRoster(members []GuildMember) error {
+	endpoint := fmt.Sprintf("%s/current/guilds/%d/members", bplBaseUrl, c.GuildId)
+	body, err := json.Marshal(members)
+	if err != nil {
+		return fmt.Errorf("failed to marshal guild roster: %w", err)
+	}
+	req, err := http.NewRequest("PUT", endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", c.BplJwt))
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusUnauthorized || res.StatusCode == http.StatusForbidden {
+		return NewCredentialError("bpl_token", fmt.Sprintf("HttpStatusCode: %d (BPL Token invalid or expired)", res.StatusCode), res.StatusCode)
+	}
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to register guild roster: %s", res.Status)
+	}
+	return nil
+}
@@ -2,19 +2,27 @@ package guild_stash_logs
 
 import (
 	"bytes"
+	"compress/gzip"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"iter"
 	"net/http"
-	"strconv"
-	"strings"
+	"slices"
+	"sync"
 	"time"
+
+	"tools/rate_limiter"
 )
 
 var bplBaseUrl = "https://v2202503259898322516.goodsrv.de/api"
 
 // var bplBaseUrl = "http://localhost:8000/api"
 
+var poeBaseUrl = "https://www.pathofexile.com"
+
 // CredentialError represents an error related to invalid credentials
 type CredentialError struct {
 	Type    string // "poe_session", "bpl_token"
@@ -34,49 +42,192 @@ func NewCredentialError(credType, message string, code int) *CredentialError {
 	}
 }
 
+// Options configures the behaviour of the stash monitor
+type Options struct {
+	// GuildId is the guild the session has to belong to. 0 accepts whatever guild the session is in.
+	GuildId int
+	// MaxRateLimitWait is the total time a history walk may sleep on 429 responses before it
+	// gives up. Every check of continuous monitoring is a walk of its own.
+	MaxRateLimitWait time.Duration
+	// Alerts configures the alert rules of continuous monitoring
+	Alerts AlertOptions
+	// Coverage configures the gap detection of coverage verification
+	Coverage CoverageOptions
+	// Polling bounds the polling interval of continuous monitoring
+	Polling PollingOptions
+	// Backfill configures how long history walks are split up and fetched in parallel
+	Backfill BackfillOptions
+	// DryRun writes the stash history to an export file instead of the BPL backend. A dry run
+	// never registers the guild, uploads anything or changes the local archive.
+	DryRun bool
+	// ExportFormat is the format of the dry run export, "jsonl" or "csv"
+	ExportFormat string
+	// ExportPath is the dry run export file. Defaults to bpl-stash-export-<guild id>-<time>.<format>
+	ExportPath string
+	// Progress is the progress output: "auto", "terminal", "line", "json" or "silent"
+	Progress string
+	// Reporter is used instead of a reporter for Progress if set, e.g. to draw several guilds on
+	// one terminal
+	Reporter ProgressReporter
+	// ForceResend uploads entries again even if they were uploaded before
+	ForceResend bool
+	// PriceFile is the JSON price table reports value the stash movements with, see PriceTable
+	PriceFile string
+}
+
+func DefaultOptions() Options {
+	return Options{
+		MaxRateLimitWait: 30 * time.Minute,
+		Alerts: AlertOptions{
+			WithdrawalLimit:  20,
+			WithdrawalWindow: 10 * time.Minute,
+			LogFile:          "bpl-stash-alerts.log",
+		},
+		Coverage: CoverageOptions{
+			BucketSize:  time.Hour,
+			Neighbours:  6,
+			MinActivity: 10,
+			DropRatio:   0.1,
+		},
+		Polling: PollingOptions{
+			MinInterval:   time.Minute,
+			MaxInterval:   15 * time.Minute,
+			TargetEntries: 50,
+			LowHeadroom:   0.2,
+			Overlap:       10 * time.Minute,
+		},
+		Backfill: BackfillOptions{
+			Workers:       4,
+			SegmentLength: 24 * time.Hour,
+		},
+		ExportFormat: "jsonl",
+		PriceFile:    "bpl-prices.json",
+	}
+}
+
 type Client struct {
-	RateLimiter    *RateLimiter
-	SessionId      string
-	BplJwt         string
-	GuildId        int
-	leagueStart    int64
-	leagueEnd      int64
-	rateLimitState string
+	RateLimiter     *rate_limiter.RateLimiter
+	SessionId       string
+	BplJwt          string
+	GuildId         int
+	Options         Options
+	leagueStart     int64
+	leagueEnd       int64
+	rateLimitState  string
+	rateLimitWaited time.Duration
+	// rateLimitWaitUntil is the end of the latest rate limit wait that was reserved
+	rateLimitWaitUntil time.Time
+	sink               StashSink
+	archive            *StashArchive
+	// walkKind is the kind of history walks the client makes, their checkpoints are kept apart
+	walkKind walkKind
+	// teams is the team resolver of the last roster sync, nil if it failed
+	teams *TeamResolver
+	// onNewEntries is called with every batch of entries that wasn't archived before
+	onNewEntries func([]GuildStashEntry)
+	// Progress shows what the client is doing
+	Progress ProgressReporter
+	// mutex guards the walk state below, the rate limit waits and onNewEntries, which the
+	// workers of a segmented walk share
+	mutex sync.Mutex
+	// walkStarted, walkEntries and walkStartPercent track the throughput of the current walk
+	walkStarted      time.Time
+	walkEntries      int
+	walkStartPercent float64
+	// walk is the segmented walk in progress, if any
+	walk *segmentedWalk
+}
+
+type GuildStashEntry struct {
+	Id      string `json:"id"`
+	Time    int64  `json:"time"`
+	League  string `json:"league"`
+	Stash   string `json:"stash"`
+	Item    string `json:"item"`
+	Action  string `json:"action"`
+	Account struct {
+		Name string `json:"name"`
+	} `json:"account"`
+	X int `json:"x"`
+	Y int `json:"y"`
+	// Parsed is the structured form of Item, filled in by parseItems
+	Parsed ParsedItem `json:"-"`
+}
+
+// parseItems fills in the parsed item of every entry
+func parseItems(entries []GuildStashEntry) {
+	for i := range entries {
+		entries[i].Parsed = ParseItem(entries[i].Item)
+	}
 }
 
 type GuildStashChangeResponse struct {
-	Entries []struct {
-		Id      string `json:"id"`
-		Time    int64  `json:"time"`
-		League  string `json:"league"`
-		Stash   string `json:"stash"`
-		Item    string `json:"item"`
-		Action  string `json:"action"`
-		Account struct {
-			Name string `json:"name"`
-		} `json:"account"`
-		X int `json:"x"`
-		Y int `json:"y"`
-	} `json:"entries"`
-	Truncated bool `json:"truncated"`
+	Entries   []GuildStashEntry `json:"entries"`
+	Truncated bool              `json:"truncated"`
 }
 
-func NewClient(sessionId, bplJwt string) (*Client, error) {
+func NewClient(sessionId, bplJwt string, options Options) (*Client, error) {
+	client, guildInfo, err := newLocalClient(sessionId, bplJwt, options)
+	if err != nil {
+		return nil, err
+	}
+	if options.DryRun {
+		path := options.ExportPath
+		if path == "" {
+			path = fmt.Sprintf("bpl-stash-export-%d-%s.%s", client.GuildId, time.Now().Format("20060102-150405"), options.ExportFormat)
+		}
+		client.sink, err = NewFileSink(path, options.ExportFormat)
+		if err != nil {
+			return nil, err
+		}
+		client.notify("Dry run: writing stash history to %s, nothing is sent to the BPL backend", path)
+	} else {
+		err = client.registerGuild(guildInfo)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to register guild: %w", err)
+		}
+		sink, err := NewBackendSink(client.GuildId, bplJwt)
+		if err != nil {
+			return nil, err
+		}
+		sink.Force = options.ForceResend
+		sink.Queue.Notify = client.notify
+		client.sink = sink
+	}
+	return client, nil
+}
+
+// newLocalClient creates a client for the guild of the session with its archive but without a
+// sink. Unlike NewClient it doesn't register anything with the BPL backend.
+func newLocalClient(sessionId, bplJwt string, options Options) (*Client, *GuildInfo, error) {
 	guildInfo, err := FetchGuildInfo(sessionId)
 	if err != nil {
-		return nil, fmt.Errorf("Failed to fetch guild info: %w", err)
+		return nil, nil, fmt.Errorf("Failed to fetch guild info: %w", err)
+	}
+	// Never touch the logs of a guild the admin didn't ask for
+	if err := guildInfo.CheckId(options.GuildId); err != nil {
+		return nil, nil, err
+	}
+	progress := options.Reporter
+	if progress == nil {
+		progress, err = NewProgressReporter(options.Progress)
+		if err != nil {
+			return nil, nil, err
+		}
 	}
 	client := &Client{
-		RateLimiter: NewRateLimiter(),
+		RateLimiter: rate_limiter.ForAccount(sessionId),
 		SessionId:   sessionId,
 		BplJwt:      bplJwt,
 		GuildId:     guildInfo.Id,
+		Options:     options,
+		Progress:    progress,
 	}
-	err = client.registerGuild(guildInfo)
+	client.archive, err = OpenStashArchive(client.GuildId)
 	if err != nil {
-		return nil, fmt.Errorf("Failed to register guild: %w", err)
+		return nil, nil, fmt.Errorf("Failed to open stash archive: %w", err)
 	}
-	return client, nil
+	return client, guildInfo, nil
 }
 
 func (c *Client) getTimestamps() (*GuildStashLogTimestampResponse, error) {
@@ -128,186 +279,334 @@ func (c *Client) registerGuild(guildInfo *GuildInfo) error {
 	return nil
 }
 
-func (c *Client) updateProgress(message string, currentTimestamp int64) {
-	// Clear the current lines and move cursor up
-	fmt.Print("\033[2K\r")        // Clear current line
-	fmt.Print("\033[1A\033[2K\r") // Move up and clear previous line
-
-	// Display rate limiter state
-	if c.RateLimiter != nil {
-		fmt.Printf("Rate Limiter: %s\n", c.RateLimiter.GetState())
-	}
-
-	if c.leagueStart != 0 && c.leagueEnd != 0 {
-		totalDuration := c.leagueEnd - c.leagueStart
-		// Since we go backwards from end to start, calculate remaining duration
-		remainingDuration := currentTimestamp - c.leagueStart
-		progressDuration := totalDuration - remainingDuration
-
-		// Ensure we don't go over 100% or below 0%
-		if progressDuration > totalDuration {
-			progressDuration = totalDuration
+// getHistoryBetween walks the stash history from start back to end, queueing every page
+// for upload and archiving it locally. It returns the cursor of the last page it fetched.
+// Only walks of the monitor save an archive cursor, nothing else resumes them.
+func (c *Client) getHistoryBetween(ctx context.Context, start int64, end int64, startId string) (newStart int64, latestId string, err error) {
+	paginator := c.NewHistoryPaginator(start, end, startId)
+	saveCursor := !c.Options.DryRun && c.walkKind == monitorWalk
+	c.startWalk()
+	err = c.storePages(paginator.Pages(ctx), func(page *HistoryPage) error {
+		if !saveCursor {
+			return nil
 		}
-		if progressDuration < 0 {
-			progressDuration = 0
+		cursor := &ArchiveCursor{End: end, FromId: page.LastId, Time: page.LastTime}
+		if err := c.archive.SaveCursor(cursor); err != nil {
+			return fmt.Errorf("failed to save archive cursor: %w", err)
 		}
-
-		percentage := int((progressDuration * 100) / totalDuration)
-		bar := strings.Repeat("=", percentage/2)
-		spaces := strings.Repeat(" ", 50-len(bar))
-
-		currentTime := time.Unix(currentTimestamp, 0).Format("2006-01-02 15:04")
-		fmt.Printf("%s [%s%s] %d%% (Current: %s)",
-			message, bar, spaces, percentage, currentTime)
-	} else {
-		fmt.Printf("%s...", message)
+		return nil
+	})
+	newStart, latestId = paginator.Cursor()
+	if err != nil || !saveCursor {
+		return newStart, latestId, err
 	}
+	return newStart, latestId, c.archive.ClearCursor()
 }
 
-func (c *Client) getHistoryBetween(start int64, end int64, startId string) (newStart int64, latestId string, err error) {
-	url := fmt.Sprintf("https://www.pathofexile.com/api/guild/%d/stash/history?from=%d&end=%d", c.GuildId, end, start)
-	if startId != "" {
-		url += fmt.Sprintf("&fromid=%s", startId)
-	}
-	c.RateLimiter.Wait()
+// storePages queues and archives every page. checkpoint is called after every page that is
+// followed by another one, so the walk can resume from there.
+func (c *Client) storePages(pages iter.Seq2[*HistoryPage, error], checkpoint func(page *HistoryPage) error) error {
+	for page, err := range pages {
+		if err != nil {
+			return err
+		}
+		// Use the timestamp of the first entry to show progress
+		c.mutex.Lock()
+		c.walkEntries += len(page.Entries)
+		c.mutex.Unlock()
+		c.updateProgress("Processing stash history", page.Entries[0].Time)
 
-	req, err := http.NewRequest("GET", url, nil)
-	if err != nil {
-		return 0, latestId, err
+		// The page has to be on disk before we move on, otherwise a failed upload loses it
+		if err := c.sink.Write(page); err != nil {
+			return err
+		}
+		// The archive counts as synced, so a dry run must not add to it
+		if !c.Options.DryRun {
+			added, err := c.archive.Append(page.Entries)
+			if err != nil {
+				return fmt.Errorf("failed to archive stash history: %w", err)
+			}
+			c.mutex.Lock()
+			if c.onNewEntries != nil && len(added) > 0 {
+				c.onNewEntries(added)
+			}
+			c.mutex.Unlock()
+		}
+		if !page.Truncated {
+			return nil
+		}
+		if err := checkpoint(page); err != nil {
+			return err
+		}
 	}
+	return nil
+}
 
-	req.Header.Add("user-agent", "Contact: liberatorist@gmail.com")
-	req.Header.Add("Cookie", fmt.Sprintf("POESESSID=%s", c.SessionId))
-
-	resp, err := http.DefaultClient.Do(req)
+// resumeInterruptedWalk finishes the history walks that were interrupted on a previous run
+func (c *Client) resumeInterruptedWalk(ctx context.Context) error {
+	checkpoint, err := c.archive.WalkCheckpoint(c.walkKind)
 	if err != nil {
-		return 0, latestId, err
+		return err
 	}
-	if resp.StatusCode == http.StatusTooManyRequests {
-		retry, err := strconv.Atoi(resp.Header.Get("retry-after"))
-		if err != nil {
-			return 0, latestId, fmt.Errorf("HttpStatusCode: %d (Too many requests - Wait 30m before trying again)", resp.StatusCode)
+	if checkpoint != nil {
+		c.notify("Resuming interrupted history walk, %d of %d segments left", checkpoint.remaining(), len(checkpoint.Segments))
+		if err := c.runSegmentedWalk(ctx, checkpoint); err != nil {
+			return err
 		}
-		duration := time.Duration(retry) * time.Second
-		return 0, latestId, fmt.Errorf("HttpStatusCode: %d (Too many requests - Wait %v before trying again)", resp.StatusCode, duration)
-	}
-	if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
-		return 0, latestId, NewCredentialError("poe_session", fmt.Sprintf("HttpStatusCode: %d (PoE Session ID most likely invalid)", resp.StatusCode), resp.StatusCode)
 	}
-	if resp.StatusCode != http.StatusOK {
-		return 0, latestId, NewCredentialError("poe_session", fmt.Sprintf("HttpStatusCode: %d (PoE Session ID most likely invalid)", resp.StatusCode), resp.StatusCode)
+	cursor, err := c.archive.Cursor()
+	if err != nil || cursor == nil {
+		return err
 	}
+	c.notify("Resuming interrupted history walk at %s", time.Unix(cursor.Time, 0).Format("2006-01-02 15:04"))
+	_, _, err = c.getHistoryBetween(ctx, cursor.Time, cursor.End, cursor.FromId)
+	return err
+}
 
-	if updateErr := c.RateLimiter.UpdateFromResponse(resp); updateErr != nil {
-		fmt.Printf("Warning: Could not update rate limiter: %v\n", updateErr)
+// fillFromArchive uses the local archive as the fetched range if the backend has none, so a
+// fresh backend doesn't force us to walk the whole league on PoE again. The backend doesn't
+// have the archived entries, so they are queued for upload.
+func (c *Client) fillFromArchive(timestamps *GuildStashLogTimestampResponse) error {
+	if timestamps.Earliest != nil && timestamps.Latest != nil {
+		return nil
 	}
-
-	body, _ := io.ReadAll(resp.Body)
-	unmarshalled := GuildStashChangeResponse{}
-	err = json.Unmarshal(body, &unmarshalled)
-	if err != nil {
-		return 0, latestId, err
+	earliest, latest, ok := c.archive.Bounds()
+	if !ok {
+		return nil
 	}
-
-	if len(unmarshalled.Entries) > 0 {
-		// Use the timestamp of the first entry to show progress
-		firstEntryTimestamp := unmarshalled.Entries[0].Time
-		c.updateProgress("Processing stash history", firstEntryTimestamp)
+	c.notify("The BPL backend has no stash history yet, uploading the local archive")
+	if err := c.queueArchive(earliest, latest); err != nil {
+		return fmt.Errorf("failed to queue archived stash history: %w", err)
 	}
+	timestamps.Earliest = &earliest
+	timestamps.Latest = &latest
+	return nil
+}
 
-	if len(unmarshalled.Entries) == 0 || !unmarshalled.Truncated {
-		return 0, latestId, nil
+// queueArchive queues every archived entry with start <= time <= end for upload, one day at a
+// time. The backend is missing them, so entries it accepted before a reset are sent again.
+func (c *Client) queueArchive(start, end int64) error {
+	sink, ok := c.sink.(*BackendSink)
+	if !ok {
+		return nil
 	}
-	go c.sendStashHistoryToBplBackend(body)
-	lastEntry := unmarshalled.Entries[len(unmarshalled.Entries)-1]
-	return c.getHistoryBetween(lastEntry.Time, end, lastEntry.Id)
+	const day = 24 * 60 * 60
+	for from := start; from <= end; from += day {
+		entries, err := c.archive.Entries(from, min(from+day-1, end))
+		if err != nil {
+			return err
+		}
+		for chunk := range slices.Chunk(entries, sink.Queue.BatchSize) {
+			body, err := json.Marshal(GuildStashChangeResponse{Entries: chunk})
+			if err != nil {
+				return err
+			}
+			if err := sink.Queue.EnqueueForce(body); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
 }
 
-func (c *Client) sendStashHistoryToBplBackend(body []byte) {
-	url := fmt.Sprintf("%s/current/guilds/%d/stash-history", bplBaseUrl, c.GuildId)
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(body))
+func (c *Client) sendStashHistoryToBplBackend(body []byte) (*AddGuildStashHistoryResponse, error) {
+	return postStashHistory(c.BplJwt, c.GuildId, body)
+}
+
+// postStashHistory uploads stash history gzip compressed. It only succeeds if the backend
+// answers with 201 and a valid AddGuildStashHistoryResponse.
+func postStashHistory(bplJwt string, guildId int, body []byte) (*AddGuildStashHistoryResponse, error) {
+	url := fmt.Sprintf("%s/current/guilds/%d/stash-history", bplBaseUrl, guildId)
+	var compressed bytes.Buffer
+	writer := gzip.NewWriter(&compressed)
+	if _, err := writer.Write(body); err != nil {
+		return nil, fmt.Errorf("error compressing request: %w", err)
+	}
+	if err := writer.Close(); err != nil {
+		return nil, fmt.Errorf("error compressing request: %w", err)
+	}
+	req, err := http.NewRequest("POST", url, &compressed)
 	if err != nil {
-		fmt.Printf("Error creating request: %v\n", err)
-		return
+		return nil, fmt.Errorf("error creating request: %w", err)
 	}
-	req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", c.BplJwt))
+	req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", bplJwt))
 	req.Header.Add("Content-Type", "application/json")
+	req.Header.Add("Content-Encoding", "gzip")
 	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
-		fmt.Printf("Error sending request: %v\n", err)
-		return
+		return nil, fmt.Errorf("error sending request: %w", err)
 	}
 	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+		return nil, NewCredentialError("bpl_token", fmt.Sprintf("HttpStatusCode: %d (BPL Token invalid or expired)", resp.StatusCode), resp.StatusCode)
+	}
 	if resp.StatusCode != http.StatusCreated {
-		fmt.Printf("Error status from BPL backend: %v\n", resp.Status)
-		return
+		return nil, fmt.Errorf("error status from BPL backend: %v", resp.Status)
 	}
 	var addResponse AddGuildStashHistoryResponse
 	if err := json.NewDecoder(resp.Body).Decode(&addResponse); err != nil {
-		fmt.Printf("Error reading add response: %v\n", err)
-		return
+		return nil, fmt.Errorf("error reading add response: %w", err)
 	}
+	return &addResponse, nil
 }
 
-func RunStashMonitoring(sessionId, bplJwt string) error {
-	client, err := NewClient(sessionId, bplJwt)
+func RunStashMonitoring(sessionId, bplJwt string, options Options) error {
+	ctx := context.Background()
+	client, err := NewClient(sessionId, bplJwt, options)
 	if err != nil {
 		return fmt.Errorf("error creating client: %w", err)
 	}
+	if !options.DryRun {
+		if err := client.trySyncRoster(); err != nil {
+			return err
+		}
+	}
 	timestamps, err := client.getTimestamps()
 	if err != nil {
 		return fmt.Errorf("error getting latest timestamp: %w", err)
 	}
+	stopUploads := client.sink.Start()
+	defer stopUploads()
 
 	// Set league times for progress calculation
 	client.leagueStart = timestamps.LeagueStart
 	client.leagueEnd = timestamps.LeagueEnd
 
+	if options.DryRun {
+		// Export the whole league, no matter what the backend already has
+		timestamps.Earliest, timestamps.Latest = nil, nil
+	} else {
+		if err := client.resumeInterruptedWalk(ctx); err != nil {
+			return fmt.Errorf("error resuming history: %w", err)
+		}
+		if err := client.fillFromArchive(timestamps); err != nil {
+			return err
+		}
+	}
+
 	dayAfterLeagueEnd := timestamps.LeagueEnd + 24*60*60
 	if timestamps.Earliest == nil || timestamps.Latest == nil {
-		_, _, err = client.getHistoryBetween(dayAfterLeagueEnd, timestamps.LeagueStart, "")
+		err = client.getHistorySegmented(ctx, dayAfterLeagueEnd, timestamps.LeagueStart)
 	} else {
-		_, _, err = client.getHistoryBetween(*timestamps.Earliest, timestamps.LeagueStart, "")
+		err = client.getHistorySegmented(ctx, *timestamps.Earliest, timestamps.LeagueStart)
 		if err != nil {
 			return fmt.Errorf("error getting history: %w", err)
 		}
-		_, _, err = client.getHistoryBetween(dayAfterLeagueEnd, *timestamps.Latest, "")
+		err = client.getHistorySegmented(ctx, dayAfterLeagueEnd, *timestamps.Latest)
 	}
 	if err != nil {
 		return fmt.Errorf("error getting history: %w", err)
 	}
-	fmt.Print("\rGuild stash monitoring completed successfully\n")
+	client.notify("Waiting for stash history uploads to finish...")
+	if err := client.sink.Flush(5 * time.Minute); err != nil {
+		return fmt.Errorf("error uploading history: %w", err)
+	}
+	client.notify("Guild stash monitoring completed successfully")
 	return nil
 }
 
-func RunStashMonitoringContinuous(sessionId, bplJwt string, interval time.Duration) error {
-	client, err := NewClient(sessionId, bplJwt)
+func RunStashMonitoringContinuous(sessionId, bplJwt string, interval time.Duration, options Options) error {
+	client, err := NewClient(sessionId, bplJwt, options)
 	if err != nil {
 		return err
 	}
-	timestamps, err := client.getTimestamps()
+	return client.monitorContinuously(context.Background(), interval)
+}
+
+// monitorContinuously syncs the whole league once and then polls for new entries. Polling starts
+// at interval, after that the interval adapts to the entry volume and rate limit headroom.
+func (c *Client) monitorContinuously(ctx context.Context, interval time.Duration) error {
+	if err := c.trySyncRoster(); err != nil {
+		return err
+	}
+	timestamps, err := c.getTimestamps()
 	if err != nil {
 		return err
 	}
+	c.leagueStart = timestamps.LeagueStart
+	c.leagueEnd = timestamps.LeagueEnd
+	stopUploads := c.sink.Start()
+	defer stopUploads()
+	if err := c.resumeInterruptedWalk(ctx); err != nil {
+		return err
+	}
+	if err := c.fillFromArchive(timestamps); err != nil {
+		return err
+	}
 	dayAfterLeagueEnd := timestamps.LeagueEnd + 24*60*60
 	if timestamps.Earliest == nil || timestamps.Latest == nil {
-		_, _, err = client.getHistoryBetween(dayAfterLeagueEnd, timestamps.LeagueStart, "")
+		err = c.getHistorySegmented(ctx, dayAfterLeagueEnd, timestamps.LeagueStart)
 	} else {
-		_, _, err = client.getHistoryBetween(*timestamps.Earliest, timestamps.LeagueStart, "")
+		err = c.getHistorySegmented(ctx, *timestamps.Earliest, timestamps.LeagueStart)
 	}
 	if err != nil {
 		return err
 	}
 
+	// Only entries that show up while we are monitoring are checked for alerts
+	alerts := NewAlertEngine(c.Options.Alerts, c.GuildId, c.Progress)
+	if resolver, err := c.loadTeamResolver(); err == nil {
+		alerts.Rules = append(alerts.Rules, &OutsiderActivityRule{Resolver: resolver})
+	} else {
+		c.notify("Warning: Could not check stash activity against the owning team: %v", err)
+	}
+	var newEntries []GuildStashEntry
+	c.onNewEntries = func(entries []GuildStashEntry) {
+		newEntries = append(newEntries, entries...)
+	}
+
+	cursor := c.syncCursor(timestamps)
+	overlap := int64(c.Options.Polling.Overlap.Seconds())
+	scheduler := NewPollScheduler(interval, c.Options.Polling)
 	for {
-		_, _, err = client.getHistoryBetween(dayAfterLeagueEnd, *timestamps.Latest, "")
-		now := time.Now().Unix()
-		timestamps.Latest = &now
-		if err != nil {
+		interval := scheduler.Interval()
+		_, _, err = c.getHistoryBetween(ctx, dayAfterLeagueEnd, max(cursor.Time-overlap, timestamps.LeagueStart), "")
+		found := len(newEntries)
+		alerts.Process(newEntries)
+		var credErr *CredentialError
+		if errors.As(err, &credErr) {
 			return err
 		}
-		time.Sleep(interval)
+		if err != nil {
+			// Keep the cursor, the next poll walks the same window again
+			c.notify("Error polling stash history: %v", err)
+		} else {
+			cursor.advance(newEntries)
+		}
+		newEntries = nil
+		// Pages that aren't accepted yet stay in the upload queue, so the cursor can move on regardless
+		flushStarted := time.Now()
+		if err := c.sink.Flush(interval); err != nil {
+			if errors.As(err, &credErr) {
+				return err
+			}
+			c.notify("%v", err)
+		}
+		interval, reason := scheduler.Next(found, c.RateLimiter.GetState().Headroom())
+		// A slow backend must not stretch the polling interval
+		wait := max(interval-time.Since(flushStarted), 0)
+		c.updateProgress(fmt.Sprintf("Up to date (newest entry %s), next check at %s (interval %v: %s)",
+			time.Unix(cursor.Time, 0).Format("15:04:05"), time.Now().Add(wait).Format("15:04:05"), interval, reason), 0)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+}
+
+// syncCursor returns the newest entry that is already synced: the newest archived entry or,
+// if the backend knows of newer ones, the backend's latest timestamp. A guild without any
+// entries starts at the league start.
+func (c *Client) syncCursor(timestamps *GuildStashLogTimestampResponse) *SyncCursor {
+	cursor := &SyncCursor{Time: timestamps.LeagueStart}
+	if _, latest, ok := c.archive.Bounds(); ok {
+		cursor.Time = latest
+	}
+	if timestamps.Latest != nil && *timestamps.Latest > cursor.Time {
+		cursor.Time = *timestamps.Latest
 	}
+	return cursor
 }
 
 type AddGuildStashHistoryResponse struct {
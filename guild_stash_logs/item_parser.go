@@ -0,0 +1,214 @@
+package guild_stash_logs
+
+import (
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// ItemRarity is a best-effort guess of an item's rarity, derived from its name alone
+type ItemRarity string
+
+const (
+	RarityCurrency   ItemRarity = "currency"
+	RarityNormal     ItemRarity = "normal"
+	RarityMagic      ItemRarity = "magic"
+	RarityRare       ItemRarity = "rare"
+	RarityUnique     ItemRarity = "unique"
+	RarityGem        ItemRarity = "gem"
+	RarityDivination ItemRarity = "divination"
+	RarityUnknown    ItemRarity = "unknown"
+)
+
+// ParsedItem is the structured form of the item string of a stash history entry
+type ParsedItem struct {
+	StackSize int
+	// Name is the unique or rare name, empty for items that don't have one
+	Name string
+	// BaseType is the base type, or the full item string if no known base type was found
+	BaseType string
+	Rarity   ItemRarity
+}
+
+var stackSizeRegex = regexp.MustCompile(`^(\d+)\s*[x×]\s+(.+)$`)
+
+// currencySuffixes identify stackable items whose name is their base type
+var currencySuffixes = []string{
+	" Orb", " Shard", " Splinter", " Catalyst", " Oil", " Fossil", " Resonator",
+	" Scarab", " Emblem", " Sextant", " Sextants", " Lifeforce", " Incubator",
+	"Scroll of Wisdom", "Portal Scroll", "Chromatic Orb", "Orb of Alteration",
+	"Orb of Alchemy", "Orb of Annulment", "Orb of Chance", "Orb of Fusing",
+	"Orb of Regret", "Orb of Scouring", "Orb of Transmutation", "Orb of Augmentation",
+	"Orb of Binding", "Orb of Horizons", "Orb of Unmaking", "Orb of Conflict",
+	"Blacksmith's Whetstone", "Armourer's Scrap", "Glassblower's Bauble",
+	"Gemcutter's Prism", "Cartographer's Chisel", "Silver Coin", "Stacked Deck",
+	"Mirror of Kalandra", "Mirror Shard", "Eldritch Chaos Orb", "Eldritch Exalted Orb",
+	"Eldritch Orb of Annulment", "Ritual Vessel",
+}
+
+var currencyPrefixes = []string{
+	"Essence of ", "Shrieking Essence of ", "Deafening Essence of ", "Screaming Essence of ",
+	"Fragment of ", "Blessing of ", "Simulacrum",
+}
+
+// knownBaseTypes is a list of common base types, used to split an item string into
+// its name and base type. It doesn't need to be complete: unknown bases are kept whole.
+var knownBaseTypes = []string{
+	// Belts, rings, amulets
+	"Leather Belt", "Heavy Belt", "Rustic Sash", "Chain Belt", "Cloth Belt", "Studded Belt",
+	"Stygian Vise", "Vanguard Belt", "Crystal Belt", "Mechalarm Belt",
+	"Iron Ring", "Coral Ring", "Paua Ring", "Gold Ring", "Ruby Ring", "Sapphire Ring",
+	"Topaz Ring", "Two-Stone Ring", "Diamond Ring", "Moonstone Ring", "Prismatic Ring",
+	"Amethyst Ring", "Unset Ring", "Steel Ring", "Opal Ring", "Vermillion Ring",
+	"Cerulean Ring", "Iolite Ring", "Bone Ring",
+	"Coral Amulet", "Paua Amulet", "Amber Amulet", "Jade Amulet", "Lapis Amulet",
+	"Gold Amulet", "Onyx Amulet", "Turquoise Amulet", "Agate Amulet", "Citrine Amulet",
+	"Marble Amulet", "Blue Pearl Amulet", "Seaglass Amulet",
+	// Jewels
+	"Cobalt Jewel", "Crimson Jewel", "Viridian Jewel", "Prismatic Jewel",
+	"Murderous Eye Jewel", "Searching Eye Jewel", "Hypnotic Eye Jewel", "Ghastly Eye Jewel",
+	"Large Cluster Jewel", "Medium Cluster Jewel", "Small Cluster Jewel", "Timeless Jewel",
+	// Body armours
+	"Simple Robe", "Silken Vest", "Vaal Regalia", "Astral Plate", "Glorious Plate",
+	"Carnal Armour", "Sadist Garb", "Assassin's Garb", "Zodiac Leather", "Full Dragonscale",
+	"Sacrificial Garb", "Saint's Hauberk", "Triumphant Lamellar", "Lacquered Garb",
+	"Occultist's Vestment", "Widowsilk Robe", "Destiny Leather", "Crypt Armour",
+	// Helmets, gloves, boots
+	"Hubris Circlet", "Lion Pelt", "Eternal Burgonet", "Royal Burgonet", "Bone Helmet",
+	"Deicide Mask", "Praetor Crown", "Solaris Circlet", "Leather Hood", "Iron Hat",
+	"Spiked Gloves", "Fingerless Silk Gloves", "Gripped Gloves", "Sorcerer Gloves",
+	"Titan Gauntlets", "Slink Gloves", "Vaal Gauntlets", "Rawhide Gloves",
+	"Two-Toned Boots", "Sorcerer Boots", "Slink Boots", "Titan Greaves", "Dragonscale Boots",
+	"Vaal Greaves", "Fugitive Boots", "Stealth Boots", "Leather Boots",
+	// Shields, quivers
+	"Titanium Spirit Shield", "Fossilised Spirit Shield", "Archon Kite Shield",
+	"Colossal Tower Shield", "Pinnacle Tower Shield", "Ezomyte Tower Shield",
+	"Spike-Point Arrow Quiver", "Broadhead Arrow Quiver", "Penetrating Arrow Quiver",
+	// Weapons
+	"Imbued Wand", "Prophecy Wand", "Convoking Wand", "Opal Wand", "Kinetic Wand",
+	"Thicket Bow", "Spine Bow", "Harbinger Bow", "Imperial Bow", "Maraketh Bow",
+	"Jewelled Foil", "Vaal Rapier", "Imperial Skean", "Ambusher", "Platinum Kris",
+	"Siege Axe", "Vaal Axe", "Jasper Chopper", "Fleshripper", "Coronal Maul",
+	"Void Sceptre", "Opal Sceptre", "Eclipse Staff", "Maelström Staff", "Judgement Staff",
+	"Crystal Sceptre", "Karui Chopper", "Behemoth Mace",
+	// Flasks
+	"Divine Life Flask", "Eternal Life Flask", "Divine Mana Flask", "Eternal Mana Flask",
+	"Silver Flask", "Quicksilver Flask", "Granite Flask", "Jade Flask", "Diamond Flask",
+	"Quartz Flask", "Basalt Flask", "Stibnite Flask", "Sulphur Flask", "Bismuth Flask",
+	"Amethyst Flask", "Ruby Flask", "Sapphire Flask", "Topaz Flask", "Aquamarine Flask",
+	"Gold Flask", "Iron Flask", "Corundum Flask",
+	// Tinctures, charms
+	"Prismatic Tincture", "Rosethorn Tincture", "Ironwood Tincture",
+}
+
+// knownUniques lists uniques whose names would otherwise look like a rare name
+var knownUniques = map[string]bool{
+	"Tabula Rasa": true, "Goldrim": true, "Wanderlust": true, "Lifesprig": true,
+	"Death's Oath": true, "Inpulsa's Broken Heart": true, "Shavronne's Wrappings": true,
+	"Aegis Aurora": true, "Militant Faith": true, "Glorious Vanity": true,
+	"Lethal Pride": true, "Brutal Restraint": true, "Elegant Hubris": true,
+	"Split Personality": true, "Watcher's Eye": true, "Thread of Hope": true,
+	"Forbidden Flame": true, "Forbidden Flesh": true, "Dying Sun": true,
+	"Bottled Faith": true, "Ashes of the Stars": true, "Mageblood": true,
+	"Headhunter": true, "Voidforge": true, "Nimis": true, "Progenesis": true,
+}
+
+func init() {
+	// Match the longest base type first, e.g. "Murderous Eye Jewel" before "Eye Jewel"
+	slices.SortStableFunc(knownBaseTypes, func(a, b string) int {
+		return len(b) - len(a)
+	})
+}
+
+// ParseItem turns the item string of a stash history entry, e.g. "3x Divine Orb" or
+// "Headhunter Leather Belt", into a ParsedItem
+func ParseItem(item string) ParsedItem {
+	parsed := ParsedItem{StackSize: 1, Rarity: RarityUnknown}
+	item = strings.TrimSpace(item)
+	if matches := stackSizeRegex.FindStringSubmatch(item); matches != nil {
+		if size, err := strconv.Atoi(matches[1]); err == nil {
+			parsed.StackSize = size
+			item = strings.TrimSpace(matches[2])
+		}
+	}
+	parsed.BaseType = item
+
+	if isCurrency(item) {
+		parsed.Rarity = RarityCurrency
+		return parsed
+	}
+	if strings.HasSuffix(item, " Support") || (strings.HasPrefix(item, "Vaal ") && !containsBaseType(item)) {
+		parsed.Rarity = RarityGem
+		return parsed
+	}
+
+	base, index := findBaseType(item)
+	if base == "" {
+		if strings.HasPrefix(item, "The ") {
+			parsed.Rarity = RarityDivination
+		}
+		return parsed
+	}
+	parsed.BaseType = base
+	prefix := strings.TrimSpace(item[:index])
+	suffix := strings.TrimSpace(item[index+len(base):])
+
+	words := len(strings.Fields(prefix))
+	switch {
+	case suffix != "":
+		// Only magic items have text after the base type ("... of the Whelpling")
+		parsed.Rarity = RarityMagic
+	case prefix == "":
+		parsed.Rarity = RarityNormal
+	case knownUniques[prefix]:
+		parsed.Name = prefix
+		parsed.Rarity = RarityUnique
+	case words == 1:
+		// A single word in front of the base is a magic prefix ("Seething", "Experimenter's")
+		parsed.Rarity = RarityMagic
+	case words == 2 && !strings.Contains(prefix, "'"):
+		// Rare names are always two words without apostrophes
+		parsed.Name = prefix
+		parsed.Rarity = RarityRare
+	default:
+		parsed.Name = prefix
+		parsed.Rarity = RarityUnique
+	}
+	return parsed
+}
+
+func isCurrency(item string) bool {
+	for _, prefix := range currencyPrefixes {
+		if strings.HasPrefix(item, prefix) {
+			return true
+		}
+	}
+	for _, suffix := range currencySuffixes {
+		if strings.HasSuffix(item, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsBaseType(item string) bool {
+	base, _ := findBaseType(item)
+	return base != ""
+}
+
+// findBaseType returns the longest known base type that appears in the item string
+// on word boundaries, and where it starts
+func findBaseType(item string) (string, int) {
+	for _, base := range knownBaseTypes {
+		index := strings.Index(item, base)
+		if index < 0 {
+			continue
+		}
+		end := index + len(base)
+		if (index == 0 || item[index-1] == ' ') && (end == len(item) || item[end] == ' ') {
+			return base, index
+		}
+	}
+	return "", -1
+}
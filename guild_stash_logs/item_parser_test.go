@@ -0,0 +1,62 @@
+package guild_stash_logs
+
+import "testing"
+
+func TestParseItem(t *testing.T) {
+	tests := []struct {
+		item string
+		want ParsedItem
+	}{
+		// Currency and other stackables
+		{"3x Divine Orb", ParsedItem{StackSize: 3, BaseType: "Divine Orb", Rarity: RarityCurrency}},
+		{"Divine Orb", ParsedItem{StackSize: 1, BaseType: "Divine Orb", Rarity: RarityCurrency}},
+		{"20x Chaos Orb", ParsedItem{StackSize: 20, BaseType: "Chaos Orb", Rarity: RarityCurrency}},
+		{"40x Orb of Alteration", ParsedItem{StackSize: 40, BaseType: "Orb of Alteration", Rarity: RarityCurrency}},
+		{"12x Scroll of Wisdom", ParsedItem{StackSize: 12, BaseType: "Scroll of Wisdom", Rarity: RarityCurrency}},
+		{"5x Awakened Sextant", ParsedItem{StackSize: 5, BaseType: "Awakened Sextant", Rarity: RarityCurrency}},
+		{"2x Deafening Essence of Greed", ParsedItem{StackSize: 2, BaseType: "Deafening Essence of Greed", Rarity: RarityCurrency}},
+		{"Fragment of the Phoenix", ParsedItem{StackSize: 1, BaseType: "Fragment of the Phoenix", Rarity: RarityCurrency}},
+		{"3x Gilded Divination Scarab", ParsedItem{StackSize: 3, BaseType: "Gilded Divination Scarab", Rarity: RarityCurrency}},
+		{"Mirror of Kalandra", ParsedItem{StackSize: 1, BaseType: "Mirror of Kalandra", Rarity: RarityCurrency}},
+		{"10x Golden Oil", ParsedItem{StackSize: 10, BaseType: "Golden Oil", Rarity: RarityCurrency}},
+		{"1x Blacksmith's Whetstone", ParsedItem{StackSize: 1, BaseType: "Blacksmith's Whetstone", Rarity: RarityCurrency}},
+
+		// Uniques
+		{"Headhunter Leather Belt", ParsedItem{StackSize: 1, Name: "Headhunter", BaseType: "Leather Belt", Rarity: RarityUnique}},
+		{"Mageblood Heavy Belt", ParsedItem{StackSize: 1, Name: "Mageblood", BaseType: "Heavy Belt", Rarity: RarityUnique}},
+		{"Tabula Rasa Simple Robe", ParsedItem{StackSize: 1, Name: "Tabula Rasa", BaseType: "Simple Robe", Rarity: RarityUnique}},
+		{"Shavronne's Wrappings Occultist's Vestment", ParsedItem{StackSize: 1, Name: "Shavronne's Wrappings", BaseType: "Occultist's Vestment", Rarity: RarityUnique}},
+		{"Ashes of the Stars Onyx Amulet", ParsedItem{StackSize: 1, Name: "Ashes of the Stars", BaseType: "Onyx Amulet", Rarity: RarityUnique}},
+		{"Kaom's Heart Glorious Plate", ParsedItem{StackSize: 1, Name: "Kaom's Heart", BaseType: "Glorious Plate", Rarity: RarityUnique}},
+		{"Lethal Pride Timeless Jewel", ParsedItem{StackSize: 1, Name: "Lethal Pride", BaseType: "Timeless Jewel", Rarity: RarityUnique}},
+
+		// Rares
+		{"Dread Bane Vaal Regalia", ParsedItem{StackSize: 1, Name: "Dread Bane", BaseType: "Vaal Regalia", Rarity: RarityRare}},
+		{"Gale Knuckle Titan Gauntlets", ParsedItem{StackSize: 1, Name: "Gale Knuckle", BaseType: "Titan Gauntlets", Rarity: RarityRare}},
+		{"Doom Loop Two-Stone Ring", ParsedItem{StackSize: 1, Name: "Doom Loop", BaseType: "Two-Stone Ring", Rarity: RarityRare}},
+		{"Rune Spark Large Cluster Jewel", ParsedItem{StackSize: 1, Name: "Rune Spark", BaseType: "Large Cluster Jewel", Rarity: RarityRare}},
+
+		// Magic and normal items
+		{"Seething Divine Life Flask of Staunching", ParsedItem{StackSize: 1, BaseType: "Divine Life Flask", Rarity: RarityMagic}},
+		{"Experimenter's Quicksilver Flask", ParsedItem{StackSize: 1, BaseType: "Quicksilver Flask", Rarity: RarityMagic}},
+		{"Sapphire Ring of the Whelpling", ParsedItem{StackSize: 1, BaseType: "Sapphire Ring", Rarity: RarityMagic}},
+		{"Stygian Vise", ParsedItem{StackSize: 1, BaseType: "Stygian Vise", Rarity: RarityNormal}},
+		{"Small Cluster Jewel", ParsedItem{StackSize: 1, BaseType: "Small Cluster Jewel", Rarity: RarityNormal}},
+
+		// Gems, divination cards and unknown items
+		{"Awakened Multistrike Support", ParsedItem{StackSize: 1, BaseType: "Awakened Multistrike Support", Rarity: RarityGem}},
+		{"Vaal Grace", ParsedItem{StackSize: 1, BaseType: "Vaal Grace", Rarity: RarityGem}},
+		{"7x The Apothecary", ParsedItem{StackSize: 7, BaseType: "The Apothecary", Rarity: RarityDivination}},
+		{"Something Completely New", ParsedItem{StackSize: 1, BaseType: "Something Completely New", Rarity: RarityUnknown}},
+		{"  2x Exalted Orb  ", ParsedItem{StackSize: 2, BaseType: "Exalted Orb", Rarity: RarityCurrency}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.item, func(t *testing.T) {
+			got := ParseItem(test.item)
+			if got != test.want {
+				t.Errorf("ParseItem(%q) = %+v, want %+v", test.item, got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,179 @@
+package guild_stash_logs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// GuildSession is one guild to monitor. GuildId is optional: if set, the session
+// has to belong to that guild.
+type GuildSession struct {
+	SessionId string
+	GuildId   int
+}
+
+// ParseGuildSessions parses a comma separated list of "POESESSID:GUILDID" pairs.
+// The guild id may be left out, e.g. "abc123:4567,def456".
+func ParseGuildSessions(value string) ([]GuildSession, error) {
+	var sessions []GuildSession
+	for _, part := range strings.Split(value, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		sessionId, guildId, hasGuildId := strings.Cut(part, ":")
+		session := GuildSession{SessionId: strings.TrimSpace(sessionId)}
+		if hasGuildId {
+			id, err := strconv.Atoi(strings.TrimSpace(guildId))
+			if err != nil {
+				return nil, fmt.Errorf("invalid guild id %q", guildId)
+			}
+			session.GuildId = id
+		}
+		if session.SessionId == "" {
+			return nil, fmt.Errorf("missing session id in %q", part)
+		}
+		sessions = append(sessions, session)
+	}
+	if len(sessions) == 0 {
+		return nil, fmt.Errorf("no guild sessions configured")
+	}
+	return sessions, nil
+}
+
+// progressBoard renders one progress line per guild and redraws all of them on every update
+type progressBoard struct {
+	mutex sync.Mutex
+	lines []string
+	drawn bool
+}
+
+func newProgressBoard(size int) *progressBoard {
+	return &progressBoard{lines: make([]string, size)}
+}
+
+func (b *progressBoard) set(index int, line string) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.lines[index] = line
+	b.redraw("")
+}
+
+// notice prints a line above the board that stays visible
+func (b *progressBoard) notice(line string) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.redraw(line)
+}
+
+// redraw draws the board again, after the notice if there is one
+func (b *progressBoard) redraw(notice string) {
+	if b.drawn {
+		// Move back up to the first line of the board
+		fmt.Printf("\033[%dA", len(b.lines))
+	}
+	if notice != "" {
+		fmt.Printf("\033[2K\r%s\n", notice)
+	}
+	for _, line := range b.lines {
+		fmt.Printf("\033[2K\r%s\n", line)
+	}
+	b.drawn = true
+}
+
+// boardProgress reports the progress of one guild as its line on a progressBoard
+type boardProgress struct {
+	board *progressBoard
+	index int
+}
+
+func (p *boardProgress) Report(event ProgressEvent) {
+	label := "Guild"
+	if event.GuildId != 0 {
+		label = fmt.Sprintf("Guild %d", event.GuildId)
+	}
+	if event.Notice {
+		p.board.notice(fmt.Sprintf("%s: %s", label, event.Message))
+		return
+	}
+	p.board.set(p.index, fmt.Sprintf("%s: %s", label, event))
+}
+
+// RunMultiGuildMonitoring monitors several guilds concurrently. Every guild runs the same
+// loop as RunStashMonitoringContinuous. On a terminal every guild gets its own progress line,
+// other progress outputs tag every event with its guild. Guilds that fail are restarted after
+// a backoff. An invalid BPL token stops all guilds, an invalid POESESSID, a guild mismatch or a
+// session without a guild only stops the guild of that session.
+func RunMultiGuildMonitoring(sessions []GuildSession, bplJwt string, interval time.Duration, options Options) error {
+	ctx, cancel := context.WithCancelCause(context.Background())
+	defer cancel(nil)
+
+	shared, err := NewProgressReporter(options.Progress)
+	if err != nil {
+		return err
+	}
+	_, onTerminal := shared.(*TerminalProgress)
+	board := newProgressBoard(len(sessions))
+	var wg sync.WaitGroup
+	errs := make([]error, len(sessions))
+	for i, session := range sessions {
+		progress := shared
+		if onTerminal {
+			progress = &boardProgress{board: board, index: i}
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := superviseGuild(ctx, session, bplJwt, interval, options, progress)
+			// The BPL token is shared by all guilds, every session has its own POESESSID
+			var credErr *CredentialError
+			if errors.As(err, &credErr) && credErr.Type == "bpl_token" {
+				cancel(err)
+			}
+			if !errors.Is(err, context.Canceled) {
+				errs[i] = err
+			}
+		}()
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// superviseGuild keeps monitoring a single guild until ctx is cancelled or a credential error occurs
+func superviseGuild(ctx context.Context, session GuildSession, bplJwt string, interval time.Duration, options Options, progress ProgressReporter) error {
+	options.GuildId = session.GuildId
+	options.Reporter = progress
+	guildId := session.GuildId
+	report := func(message string) {
+		progress.Report(ProgressEvent{Time: time.Now(), GuildId: guildId, Message: message, Percent: -1})
+	}
+	backoff := 30 * time.Second
+	for {
+		report("Connecting...")
+		client, err := NewClient(session.SessionId, bplJwt, options)
+		if err == nil {
+			guildId = client.GuildId
+			err = client.monitorContinuously(ctx, interval)
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		var credErr *CredentialError
+		if errors.As(err, &credErr) || errors.Is(err, ErrGuildMismatch) || errors.Is(err, ErrNotInGuild) {
+			report(fmt.Sprintf("stopped: %v", err))
+			return err
+		}
+		report(fmt.Sprintf("%v, restarting at %s", err, time.Now().Add(backoff).Format("15:04:05")))
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, 10*time.Minute)
+	}
+}
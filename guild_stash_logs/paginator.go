@@ -0,0 +1,235 @@
+package guild_stash_logs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"iter"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// HistoryPage is a single page of the PoE guild stash history API
+type HistoryPage struct {
+	Entries   []GuildStashEntry
+	Truncated bool
+	// LastId and LastTime belong to the oldest entry of the page and form the cursor for the next page
+	LastId   string
+	LastTime int64
+	// Body is the raw response as returned by PoE
+	Body []byte
+}
+
+// HistoryPaginator walks the stash history of a guild from Start backwards to End,
+// one page at a time
+type HistoryPaginator struct {
+	client *Client
+	Start  int64
+	End    int64
+	FromId string
+
+	lastId   string
+	lastTime int64
+	pages    int
+}
+
+// NewHistoryPaginator creates a paginator for all entries between start and end (start > end).
+// fromId continues a previous walk from the given entry.
+func (c *Client) NewHistoryPaginator(start, end int64, fromId string) *HistoryPaginator {
+	return &HistoryPaginator{
+		client:   c,
+		Start:    start,
+		End:      end,
+		FromId:   fromId,
+		lastId:   fromId,
+		lastTime: start,
+	}
+}
+
+// Cursor returns the position of the last page that was fetched
+func (p *HistoryPaginator) Cursor() (lastTime int64, lastId string) {
+	return p.lastTime, p.lastId
+}
+
+// PageCount returns the number of pages fetched so far
+func (p *HistoryPaginator) PageCount() int {
+	return p.pages
+}
+
+// Pages yields every page of the walk. Iteration stops after the first error,
+// when the context is cancelled or when PoE reports no further pages.
+func (p *HistoryPaginator) Pages(ctx context.Context) iter.Seq2[*HistoryPage, error] {
+	return func(yield func(*HistoryPage, error) bool) {
+		for {
+			if err := ctx.Err(); err != nil {
+				yield(nil, err)
+				return
+			}
+			page, err := p.client.fetchHistoryPage(ctx, p.lastTime, p.End, p.lastId)
+			if err != nil {
+				yield(nil, err)
+				return
+			}
+			p.pages++
+			if len(page.Entries) == 0 {
+				return
+			}
+			p.lastTime, p.lastId = page.LastTime, page.LastId
+			if !yield(page, nil) || !page.Truncated {
+				return
+			}
+		}
+	}
+}
+
+// Entries yields the entries of every page, newest first
+func (p *HistoryPaginator) Entries(ctx context.Context) iter.Seq2[GuildStashEntry, error] {
+	return func(yield func(GuildStashEntry, error) bool) {
+		for page, err := range p.Pages(ctx) {
+			if err != nil {
+				yield(GuildStashEntry{}, err)
+				return
+			}
+			for _, entry := range page.Entries {
+				if !yield(entry, nil) {
+					return
+				}
+			}
+		}
+	}
+}
+
+// rateLimitedError is returned when PoE answers with 429 Too Many Requests
+type rateLimitedError struct {
+	RetryAfter time.Duration
+}
+
+func (e *rateLimitedError) Error() string {
+	return fmt.Sprintf("HttpStatusCode: %d (Too many requests - Wait %v before trying again)", http.StatusTooManyRequests, e.RetryAfter)
+}
+
+// fetchHistoryPage requests a single page of stash history from PoE. When we get rate
+// limited it sleeps for the requested time and retries the same page until the total
+// wait would exceed MaxRateLimitWait.
+func (c *Client) fetchHistoryPage(ctx context.Context, start, end int64, fromId string) (*HistoryPage, error) {
+	for {
+		page, err := c.requestHistoryPage(ctx, start, end, fromId)
+		var limited *rateLimitedError
+		if !errors.As(err, &limited) {
+			return page, err
+		}
+		c.RateLimiter.Penalize(limited.RetryAfter)
+		if waited, ok := c.reserveRateLimitWait(time.Now(), limited.RetryAfter); !ok {
+			return nil, fmt.Errorf("giving up after waiting %v for rate limits: %w", waited, err)
+		}
+		if err := c.sleepWithCountdown(ctx, limited.RetryAfter, "Rate limited by PoE, resuming in"); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// reserveRateLimitWait adds a wait from now to the time spent waiting for rate limits unless
+// that would exceed MaxRateLimitWait. Only the part of the wait that goes past the waits
+// reserved before counts, so workers that are hit by the same 429 pay for it once. It returns
+// the time waited so far.
+func (c *Client) reserveRateLimitWait(now time.Time, wait time.Duration) (time.Duration, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	until := now.Add(wait)
+	charge := min(max(until.Sub(c.rateLimitWaitUntil), 0), wait)
+	if c.rateLimitWaited+charge > c.Options.MaxRateLimitWait {
+		return c.rateLimitWaited, false
+	}
+	c.rateLimitWaited += charge
+	if until.After(c.rateLimitWaitUntil) {
+		c.rateLimitWaitUntil = until
+	}
+	return c.rateLimitWaited, true
+}
+
+// sleepWithCountdown sleeps for the given duration while showing the remaining time
+func (c *Client) sleepWithCountdown(ctx context.Context, duration time.Duration, message string) error {
+	deadline := time.Now().Add(duration)
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		remaining := time.Until(deadline).Round(time.Second)
+		c.updateProgress(fmt.Sprintf("%s %v", message, remaining), 0)
+		if remaining <= 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// historyEndpoint names the stash history API for the rate limiter
+const historyEndpoint = "guild-stash-history"
+
+func (c *Client) requestHistoryPage(ctx context.Context, start, end int64, fromId string) (*HistoryPage, error) {
+	url := fmt.Sprintf("%s/api/guild/%d/stash/history?from=%d&end=%d", poeBaseUrl, c.GuildId, end, start)
+	if fromId != "" {
+		url += fmt.Sprintf("&fromid=%s", fromId)
+	}
+	if _, err := c.RateLimiter.Wait(ctx, historyEndpoint); err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Add("user-agent", "Contact: liberatorist@gmail.com")
+	req.Header.Add("Cookie", fmt.Sprintf("POESESSID=%s", c.SessionId))
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusTooManyRequests {
+		retry, err := strconv.Atoi(resp.Header.Get("retry-after"))
+		if err != nil {
+			// PoE always sends retry-after, so this is just a conservative guess
+			retry = 60
+		}
+		return nil, &rateLimitedError{RetryAfter: time.Duration(retry) * time.Second}
+	}
+	if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+		return nil, NewCredentialError("poe_session", fmt.Sprintf("HttpStatusCode: %d (PoE Session ID most likely invalid)", resp.StatusCode), resp.StatusCode)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, NewCredentialError("poe_session", fmt.Sprintf("HttpStatusCode: %d (PoE Session ID most likely invalid)", resp.StatusCode), resp.StatusCode)
+	}
+
+	if updateErr := c.RateLimiter.UpdateFromResponse(historyEndpoint, resp); updateErr != nil {
+		c.notify("Warning: Could not update rate limiter: %v", updateErr)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	unmarshalled := GuildStashChangeResponse{}
+	if err := json.Unmarshal(body, &unmarshalled); err != nil {
+		return nil, err
+	}
+	parseItems(unmarshalled.Entries)
+	page := &HistoryPage{
+		Entries:   unmarshalled.Entries,
+		Truncated: unmarshalled.Truncated,
+		Body:      body,
+	}
+	if len(page.Entries) > 0 {
+		lastEntry := page.Entries[len(page.Entries)-1]
+		page.LastId, page.LastTime = lastEntry.Id, lastEntry.Time
+	}
+	return page, nil
+}
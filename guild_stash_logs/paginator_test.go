@@ -0,0 +1,179 @@
+package guild_stash_logs
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"tools/rate_limiter"
+)
+
+func TestReserveRateLimitWait(t *testing.T) {
+	now := time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+	// wait is a 429 that arrives after offset and asks to wait for retryAfter
+	type wait struct {
+		offset     time.Duration
+		retryAfter time.Duration
+	}
+	tests := []struct {
+		name       string
+		waits      []wait
+		wantWaited time.Duration
+		wantOk     bool
+	}{
+		{"single wait", []wait{{0, 10 * time.Minute}}, 10 * time.Minute, true},
+		{"same penalty for four workers", []wait{{0, 10 * time.Minute}, {0, 10 * time.Minute}, {0, 10 * time.Minute}, {0, 10 * time.Minute}}, 10 * time.Minute, true},
+		{"overlapping waits", []wait{{0, 10 * time.Minute}, {5 * time.Minute, 10 * time.Minute}}, 15 * time.Minute, true},
+		{"consecutive waits", []wait{{0, 10 * time.Minute}, {20 * time.Minute, 10 * time.Minute}}, 20 * time.Minute, true},
+		{"shorter wait within a longer one", []wait{{0, 10 * time.Minute}, {time.Minute, time.Minute}}, 10 * time.Minute, true},
+		{"budget exceeded", []wait{{0, 20 * time.Minute}, {time.Hour, 20 * time.Minute}}, 20 * time.Minute, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client := &Client{Options: Options{MaxRateLimitWait: 30 * time.Minute}}
+			var waited time.Duration
+			ok := true
+			for _, wait := range test.waits {
+				waited, ok = client.reserveRateLimitWait(now.Add(wait.offset), wait.retryAfter)
+			}
+			if waited != test.wantWaited || ok != test.wantOk {
+				t.Errorf("waited %v, %v, want %v, %v", waited, ok, test.wantWaited, test.wantOk)
+			}
+		})
+	}
+}
+
+func TestReserveRateLimitWaitConcurrent(t *testing.T) {
+	now := time.Now()
+	client := &Client{Options: Options{MaxRateLimitWait: 30 * time.Minute}}
+	var wg sync.WaitGroup
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, ok := client.reserveRateLimitWait(now, 10*time.Minute); !ok {
+				t.Error("a worker gave up on a penalty the walk already waits for")
+			}
+		}()
+	}
+	wg.Wait()
+	if client.rateLimitWaited != 10*time.Minute {
+		t.Errorf("waited %v, want %v", client.rateLimitWaited, 10*time.Minute)
+	}
+}
+
+// historyServer serves the given entries, newest first, like the PoE stash history API with
+// pages of pageSize entries. The first requests are answered with the statuses in failures,
+// which ask to retry after retryAfter seconds.
+func historyServer(t *testing.T, entries []GuildStashEntry, pageSize int, failures []int, retryAfter int) {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(failures) > 0 {
+			status := failures[0]
+			failures = failures[1:]
+			w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+			w.WriteHeader(status)
+			return
+		}
+		query := r.URL.Query()
+		from, _ := strconv.ParseInt(query.Get("from"), 10, 64)
+		end, _ := strconv.ParseInt(query.Get("end"), 10, 64)
+		var page []GuildStashEntry
+		skipping := query.Get("fromid") != ""
+		for _, entry := range entries {
+			if skipping {
+				skipping = entry.Id != query.Get("fromid")
+				continue
+			}
+			if entry.Time <= end && entry.Time >= from {
+				page = append(page, entry)
+			}
+		}
+		truncated := len(page) > pageSize
+		if truncated {
+			page = page[:pageSize]
+		}
+		w.Header().Set("X-Rate-Limit-Policy", "stash-history-request-limit")
+		w.Header().Set("X-Rate-Limit-Account", "60:60:60")
+		w.Header().Set("X-Rate-Limit-Account-State", "1:60:0")
+		json.NewEncoder(w).Encode(GuildStashChangeResponse{Entries: page, Truncated: truncated})
+	}))
+	t.Cleanup(server.Close)
+	baseUrl := poeBaseUrl
+	poeBaseUrl = server.URL
+	t.Cleanup(func() { poeBaseUrl = baseUrl })
+}
+
+func TestHistoryPaginator(t *testing.T) {
+	entries := []GuildStashEntry{
+		stashEntry("5", 500, "added", "a", "Divine Orb", 0, 0),
+		stashEntry("4", 400, "added", "a", "Divine Orb", 0, 0),
+		stashEntry("3", 300, "added", "a", "Divine Orb", 0, 0),
+		stashEntry("2", 200, "added", "a", "Divine Orb", 0, 0),
+		stashEntry("1", 100, "added", "a", "Divine Orb", 0, 0),
+	}
+	tests := []struct {
+		name       string
+		start, end int64
+		fromId     string
+		pageSize   int
+		failures   []int
+		retryAfter int
+		maxWait    time.Duration
+		wantIds    []string
+		wantPages  int
+		wantCursor string
+		wantErr    bool
+	}{
+		{"single page", 500, 0, "", 10, nil, 0, time.Minute, []string{"5", "4", "3", "2", "1"}, 1, "1", false},
+		{"several pages", 500, 0, "", 2, nil, 0, time.Minute, []string{"5", "4", "3", "2", "1"}, 3, "1", false},
+		{"window", 400, 200, "", 2, nil, 0, time.Minute, []string{"4", "3", "2"}, 2, "2", false},
+		{"resumed walk", 500, 0, "3", 2, nil, 0, time.Minute, []string{"2", "1"}, 1, "1", false},
+		{"no entries", 50, 0, "", 2, nil, 0, time.Minute, nil, 1, "", false},
+		{"rate limited", 500, 0, "", 10, []int{http.StatusTooManyRequests}, 0, time.Minute, []string{"5", "4", "3", "2", "1"}, 1, "1", false},
+		{"rejected session", 500, 0, "", 10, []int{http.StatusUnauthorized}, 0, time.Minute, nil, 0, "", true},
+		{"backend error", 500, 0, "", 10, []int{http.StatusInternalServerError}, 0, time.Minute, nil, 0, "", true},
+		{"rate limit wait exceeded", 500, 0, "", 10, []int{http.StatusTooManyRequests}, 1, 0, nil, 0, "", true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			historyServer(t, entries, test.pageSize, test.failures, test.retryAfter)
+			client := &Client{
+				RateLimiter: rate_limiter.NewRateLimiter(),
+				GuildId:     1,
+				Options:     Options{MaxRateLimitWait: test.maxWait},
+				Progress:    SilentProgress{},
+			}
+			paginator := client.NewHistoryPaginator(test.start, test.end, test.fromId)
+			var ids []string
+			var err error
+			for entry, entryErr := range paginator.Entries(context.Background()) {
+				if entryErr != nil {
+					err = entryErr
+					break
+				}
+				ids = append(ids, entry.Id)
+			}
+			if (err != nil) != test.wantErr {
+				t.Fatalf("Entries() error = %v, want error %v", err, test.wantErr)
+			}
+			if !slices.Equal(ids, test.wantIds) {
+				t.Errorf("Entries() = %v, want %v", ids, test.wantIds)
+			}
+			if pages := paginator.PageCount(); pages != test.wantPages {
+				t.Errorf("fetched %d pages, want %d", pages, test.wantPages)
+			}
+			if _, lastId := paginator.Cursor(); test.wantCursor != "" && lastId != test.wantCursor {
+				t.Errorf("cursor at %q, want %q", lastId, test.wantCursor)
+			}
+		})
+	}
+}
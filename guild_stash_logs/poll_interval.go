@@ -0,0 +1,88 @@
+package guild_stash_logs
+
+import (
+	"fmt"
+	"time"
+)
+
+// PollingOptions bounds the adaptive polling interval of continuous monitoring
+type PollingOptions struct {
+	MinInterval time.Duration
+	MaxInterval time.Duration
+	// TargetEntries is the number of new entries we'd like to see per poll. Busier guilds are
+	// polled more often, quieter ones less.
+	TargetEntries int
+	// LowHeadroom is the rate limit headroom below which polling slows down
+	LowHeadroom float64
+	// Overlap is how far every poll reaches back before the newest entry seen so far, to
+	// catch entries PoE publishes late. Entries seen twice are de-duplicated.
+	Overlap time.Duration
+}
+
+// SyncCursor is the time of the newest entry continuous monitoring has seen. PoE's fromid only
+// continues a walk towards older entries, so polls are bounded by time alone. The poll overlap
+// and the de-duplication by entry id catch entries that share a timestamp or show up late.
+type SyncCursor struct {
+	Time int64
+}
+
+// advance moves the cursor to the newest of the given entries
+func (c *SyncCursor) advance(entries []GuildStashEntry) {
+	for _, entry := range entries {
+		c.Time = max(c.Time, entry.Time)
+	}
+}
+
+// PollScheduler picks the time until the next poll from the entry volume of the last poll
+// and the rate limit headroom. The interval changes by at most a factor of two per poll.
+type PollScheduler struct {
+	Options  PollingOptions
+	interval time.Duration
+}
+
+func NewPollScheduler(initial time.Duration, options PollingOptions) *PollScheduler {
+	// The interval is divided by, so it must never reach 0
+	options.MinInterval = max(options.MinInterval, time.Second)
+	return &PollScheduler{Options: options, interval: clampDuration(initial, options.MinInterval, options.MaxInterval)}
+}
+
+// Interval returns the current interval
+func (s *PollScheduler) Interval() time.Duration {
+	return s.interval
+}
+
+// Next adapts the interval to the last poll, which found newEntries over the current interval,
+// and returns the new interval together with the reason for it
+func (s *PollScheduler) Next(newEntries int, headroom float64) (time.Duration, string) {
+	var next time.Duration
+	var reason string
+	switch {
+	case headroom < s.Options.LowHeadroom:
+		next = s.interval * 2
+		reason = fmt.Sprintf("rate limit headroom %.0f%%", headroom*100)
+	case newEntries == 0:
+		next = s.interval * 2
+		reason = "quiet, no new entries"
+	default:
+		// Aim for TargetEntries per poll at the current entry rate
+		perSecond := float64(newEntries) / s.interval.Seconds()
+		next = time.Duration(float64(s.Options.TargetEntries) / perSecond * float64(time.Second))
+		next = clampDuration(next, s.interval/2, s.interval*2)
+		reason = fmt.Sprintf("%d new entries in %v", newEntries, s.interval.Round(time.Second))
+		if next < s.interval {
+			reason = "busy, " + reason
+		}
+	}
+	s.interval = clampDuration(next, s.Options.MinInterval, s.Options.MaxInterval).Round(time.Second)
+	return s.interval, reason
+}
+
+func clampDuration(d, lower, upper time.Duration) time.Duration {
+	if upper > 0 && d > upper {
+		d = upper
+	}
+	if d < lower {
+		d = lower
+	}
+	return d
+}
@@ -0,0 +1,234 @@
+package guild_stash_logs
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/term"
+)
+
+// ProgressEvent is a snapshot of what the stash monitor is doing
+type ProgressEvent struct {
+	Time    time.Time `json:"time"`
+	GuildId int       `json:"guild_id"`
+	Message string    `json:"message"`
+	// Current is the time of the stash history the walk has reached, 0 if there is none
+	Current int64 `json:"current,omitempty"`
+	// Percent is the progress of the current walk, -1 if unknown
+	Percent          float64       `json:"percent"`
+	Entries          int           `json:"entries"`
+	EntriesPerSecond float64       `json:"entries_per_second"`
+	ETA              time.Duration `json:"-"`
+	RateLimit        string        `json:"rate_limit,omitempty"`
+	// Notice marks messages that stay visible instead of being replaced by the next event,
+	// such as warnings and alerts
+	Notice bool `json:"notice,omitempty"`
+}
+
+// String renders the event as a single line with a progress bar if the progress is known
+func (e ProgressEvent) String() string {
+	if e.Percent < 0 {
+		return e.Message
+	}
+	bar := strings.Repeat("=", int(e.Percent)/2)
+	spaces := strings.Repeat(" ", 50-len(bar))
+	line := fmt.Sprintf("%s [%s%s] %d%%", e.Message, bar, spaces, int(e.Percent))
+	// Segmented walks report a percentage even for messages that aren't at a position
+	if e.Current != 0 {
+		line += fmt.Sprintf(" (Current: %s)", time.Unix(e.Current, 0).Format("2006-01-02 15:04"))
+	}
+	if e.EntriesPerSecond > 0 {
+		line += fmt.Sprintf(" %.1f entries/s", e.EntriesPerSecond)
+	}
+	if e.ETA > 0 {
+		line += fmt.Sprintf(", ETA %v", e.ETA.Round(time.Second))
+	}
+	return line
+}
+
+// ProgressReporter shows progress events to the user
+type ProgressReporter interface {
+	Report(event ProgressEvent)
+}
+
+// NewProgressReporter returns the reporter for a mode: "terminal", "line", "json", "silent",
+// or "auto"/"" to pick the terminal reporter if stdout is a terminal and line output otherwise
+func NewProgressReporter(mode string) (ProgressReporter, error) {
+	switch mode {
+	case "", "auto":
+		if stdoutIsTerminal() {
+			return &TerminalProgress{}, nil
+		}
+		return &LineProgress{Writer: os.Stdout, Interval: 10 * time.Second}, nil
+	case "terminal":
+		return &TerminalProgress{}, nil
+	case "line":
+		return &LineProgress{Writer: os.Stdout, Interval: 10 * time.Second}, nil
+	case "json":
+		return &JSONProgress{Writer: os.Stdout}, nil
+	case "silent":
+		return SilentProgress{}, nil
+	default:
+		return nil, fmt.Errorf("unknown progress output %q, expected auto, terminal, line, json or silent", mode)
+	}
+}
+
+func stdoutIsTerminal() bool {
+	return term.IsTerminal(int(os.Stdout.Fd()))
+}
+
+// TerminalProgress redraws the rate limiter state and a progress bar in place. Notices are
+// printed above them.
+type TerminalProgress struct {
+	mutex sync.Mutex
+	// lines is the number of lines above the progress bar that belong to it
+	lines int
+}
+
+func (p *TerminalProgress) Report(event ProgressEvent) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	// Clear the current line and the lines drawn above it
+	fmt.Print("\033[2K\r")
+	for range p.lines {
+		fmt.Print("\033[1A\033[2K\r")
+	}
+	p.lines = 0
+	if event.Notice {
+		fmt.Println(event.Message)
+		return
+	}
+
+	// Display rate limiter state
+	if event.RateLimit != "" {
+		fmt.Printf("Rate Limiter: %s\n", event.RateLimit)
+		p.lines = 1
+	}
+	fmt.Print(event)
+}
+
+// LineProgress writes plain, timestamped lines for logs and pipes. It writes at most one line
+// per Interval unless the message changes.
+type LineProgress struct {
+	Writer   io.Writer
+	Interval time.Duration
+
+	mutex       sync.Mutex
+	lastMessage string
+	lastWrite   time.Time
+}
+
+func (p *LineProgress) Report(event ProgressEvent) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if !event.Notice {
+		if event.Message == p.lastMessage && event.Time.Sub(p.lastWrite) < p.Interval {
+			return
+		}
+		p.lastMessage, p.lastWrite = event.Message, event.Time
+	}
+	prefix := event.Time.Format("2006-01-02 15:04:05")
+	if event.GuildId != 0 {
+		prefix += fmt.Sprintf(" [guild %d]", event.GuildId)
+	}
+	fmt.Fprintf(p.Writer, "%s %s\n", prefix, event)
+}
+
+// JSONProgress writes every event as a line of JSON, with the ETA in seconds
+type JSONProgress struct {
+	Writer io.Writer
+
+	mutex sync.Mutex
+}
+
+func (p *JSONProgress) Report(event ProgressEvent) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	json.NewEncoder(p.Writer).Encode(struct {
+		ProgressEvent
+		ETASeconds float64 `json:"eta_seconds"`
+	}{event, event.ETA.Seconds()})
+}
+
+// SilentProgress drops all progress events. Notices are still written to stderr.
+type SilentProgress struct{}
+
+func (SilentProgress) Report(event ProgressEvent) {
+	if event.Notice {
+		fmt.Fprintln(os.Stderr, event.Message)
+	}
+}
+
+// notify shows a message that stays visible, such as a warning, through the progress reporter
+func (c *Client) notify(format string, args ...any) {
+	c.Progress.Report(ProgressEvent{
+		Time:    time.Now(),
+		GuildId: c.GuildId,
+		Message: fmt.Sprintf(format, args...),
+		Percent: -1,
+		Notice:  true,
+	})
+}
+
+// updateProgress reports the progress of the current walk, which has reached currentTimestamp.
+// A currentTimestamp of 0 reports a message without progress.
+func (c *Client) updateProgress(message string, currentTimestamp int64) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	event := ProgressEvent{
+		Time:    time.Now(),
+		GuildId: c.GuildId,
+		Message: message,
+		Current: currentTimestamp,
+		Percent: -1,
+		Entries: c.walkEntries,
+	}
+	if c.RateLimiter != nil {
+		event.RateLimit = c.RateLimiter.GetState().String()
+	}
+	elapsed := time.Since(c.walkStarted)
+	if c.walkEntries > 0 && elapsed > 0 {
+		event.EntriesPerSecond = float64(c.walkEntries) / elapsed.Seconds()
+	}
+	if percent, ok := c.walkPercent(currentTimestamp); ok {
+		event.Percent = percent
+		if c.walkStartPercent < 0 {
+			c.walkStartPercent = percent
+		}
+		// Extrapolate from how fast the percentage went up since the walk started
+		if done := percent - c.walkStartPercent; done > 0 {
+			event.ETA = time.Duration(float64(elapsed) / done * (100 - percent))
+		}
+	}
+	c.Progress.Report(event)
+}
+
+// walkPercent returns how much of the range between leagueEnd and leagueStart was walked.
+// Walks go backwards in time, so reaching leagueStart is 100%. Segmented walks combine the
+// progress of all segments instead.
+func (c *Client) walkPercent(currentTimestamp int64) (float64, bool) {
+	if c.walk != nil {
+		return c.walk.percent(), true
+	}
+	if currentTimestamp == 0 || c.leagueStart == 0 || c.leagueEnd <= c.leagueStart {
+		return 0, false
+	}
+	done := float64(c.leagueEnd-currentTimestamp) / float64(c.leagueEnd-c.leagueStart) * 100
+	return min(max(done, 0), 100), true
+}
+
+// startWalk resets the throughput and ETA tracking and the rate limit wait budget for a new walk
+func (c *Client) startWalk() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.rateLimitWaited = 0
+	c.walkStarted = time.Now()
+	c.walkEntries = 0
+	c.walkStartPercent = -1
+}
@@ -0,0 +1,373 @@
+package guild_stash_logs
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// ContributionRow summarises what an account put into and took out of a stash tab, or the
+// totals of an account, a tab or a day, depending on the list of the report it is in
+type ContributionRow struct {
+	Account      string `json:"account"`
+	Stash        string `json:"stash,omitempty"`
+	Day          string `json:"day,omitempty"`
+	Added        int    `json:"added"`
+	Removed      int    `json:"removed"`
+	AddedItems   int    `json:"added_items"`
+	RemovedItems int    `json:"removed_items"`
+	// Team is the BPL team of the account, if known
+	Team string `json:"team,omitempty"`
+	// Outsider is set for accounts that are not on the team that owns the guild
+	Outsider bool `json:"outsider"`
+	// Deposited and Withdrawn are the chaos values of the added and removed items that have a price
+	Deposited float64 `json:"deposited_chaos"`
+	Withdrawn float64 `json:"withdrawn_chaos"`
+	Net       float64 `json:"net_chaos"`
+}
+
+// add counts the entry and, if prices is not nil, its value
+func (r *ContributionRow) add(entry GuildStashEntry, prices *PriceTable) {
+	var value float64
+	if prices != nil {
+		value, _ = prices.Value(entry)
+	}
+	switch entry.Action {
+	case "added":
+		r.Added++
+		r.AddedItems += entry.Parsed.StackSize
+		r.Deposited += value
+	case "removed":
+		r.Removed++
+		r.RemovedItems += entry.Parsed.StackSize
+		r.Withdrawn += value
+	}
+	r.Net = r.Deposited - r.Withdrawn
+}
+
+// ContributionReport is the per-account and per-tab summary of a time window
+type ContributionReport struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+	// OwningTeam is the team that owns the guild, empty if outsiders weren't checked
+	OwningTeam string            `json:"owning_team,omitempty"`
+	Rows       []ContributionRow `json:"rows"`
+	Accounts   []ContributionRow `json:"accounts"`
+	Tabs       []ContributionRow `json:"tabs"`
+	Days       []ContributionRow `json:"days"`
+	// Valued is set if the chaos values were calculated from a price table
+	Valued bool `json:"valued"`
+	// Unpriced lists the items without a price, most frequent first
+	Unpriced []string `json:"unpriced_items,omitempty"`
+}
+
+// BuildContributionReport summarises all entries with start <= time <= end. If prices is not
+// nil the moved items are valued in chaos, days are local calendar days.
+func BuildContributionReport(entries []GuildStashEntry, start, end int64, prices *PriceTable) *ContributionReport {
+	// The kind keeps the totals apart from rows whose account or tab name happens to be empty
+	type rowKind int
+	const (
+		accountTabRow rowKind = iota
+		accountRow
+		tabRow
+		dayRow
+	)
+	type rowKey struct {
+		kind                rowKind
+		account, stash, day string
+	}
+	rows := make(map[rowKey]*ContributionRow)
+	unpriced := make(map[string]int)
+	add := func(key rowKey, entry GuildStashEntry) {
+		if rows[key] == nil {
+			rows[key] = &ContributionRow{Account: key.account, Stash: key.stash, Day: key.day}
+		}
+		rows[key].add(entry, prices)
+	}
+
+	for _, entry := range entries {
+		if entry.Time < start || entry.Time > end {
+			continue
+		}
+		add(rowKey{kind: accountTabRow, account: entry.Account.Name, stash: entry.Stash}, entry)
+		add(rowKey{kind: accountRow, account: entry.Account.Name}, entry)
+		add(rowKey{kind: tabRow, stash: entry.Stash}, entry)
+		add(rowKey{kind: dayRow, day: time.Unix(entry.Time, 0).Format("2006-01-02")}, entry)
+		if prices != nil {
+			if _, ok := prices.Price(entry.Item, entry.Parsed); !ok {
+				unpriced[stackName(strings.TrimSpace(entry.Item))]++
+			}
+		}
+	}
+
+	report := &ContributionReport{
+		Start:  time.Unix(start, 0),
+		End:    time.Unix(end, 0),
+		Valued: prices != nil,
+	}
+	for key, row := range rows {
+		switch key.kind {
+		case accountTabRow:
+			report.Rows = append(report.Rows, *row)
+		case accountRow:
+			report.Accounts = append(report.Accounts, *row)
+		case tabRow:
+			report.Tabs = append(report.Tabs, *row)
+		case dayRow:
+			report.Days = append(report.Days, *row)
+		}
+	}
+	compare := func(a, b ContributionRow) int {
+		if c := strings.Compare(strings.ToLower(a.Account), strings.ToLower(b.Account)); c != 0 {
+			return c
+		}
+		if c := strings.Compare(a.Stash, b.Stash); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Day, b.Day)
+	}
+	slices.SortFunc(report.Rows, compare)
+	slices.SortFunc(report.Accounts, compare)
+	slices.SortFunc(report.Tabs, compare)
+	slices.SortFunc(report.Days, compare)
+
+	for item := range unpriced {
+		report.Unpriced = append(report.Unpriced, item)
+	}
+	slices.SortFunc(report.Unpriced, func(a, b string) int {
+		if c := unpriced[b] - unpriced[a]; c != 0 {
+			return c
+		}
+		return strings.Compare(a, b)
+	})
+	return report
+}
+
+// FlagOutsiders fills in the team of every account and flags the ones that are not on the
+// team that owns the guild
+func (r *ContributionReport) FlagOutsiders(resolver *TeamResolver) {
+	if resolver.OwningTeam != nil {
+		r.OwningTeam = resolver.TeamName(*resolver.OwningTeam)
+	}
+	for _, rows := range [][]ContributionRow{r.Rows, r.Accounts} {
+		for i := range rows {
+			rows[i].Team = resolver.Resolve(rows[i].Account).String()
+			rows[i].Outsider = resolver.IsOutsider(rows[i].Account)
+		}
+	}
+}
+
+// writeSection writes rows as a table: the label columns, the counts and, if the report is
+// valued, the chaos values
+func (r *ContributionReport) writeSection(w io.Writer, labels []string, rows []ContributionRow, cells func(row ContributionRow) []string) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	header := append(labels, "Added", "Removed", "Items added", "Items removed")
+	if r.Valued {
+		header = append(header, "Deposited (c)", "Withdrawn (c)", "Net (c)")
+	}
+	fmt.Fprintln(tw, strings.Join(header, "\t")+"\t")
+	for _, row := range rows {
+		line := append(cells(row), strconv.Itoa(row.Added), strconv.Itoa(row.Removed), strconv.Itoa(row.AddedItems), strconv.Itoa(row.RemovedItems))
+		if r.Valued {
+			line = append(line, fmt.Sprintf("%.1f", row.Deposited), fmt.Sprintf("%.1f", row.Withdrawn), fmt.Sprintf("%+.1f", row.Net))
+		}
+		fmt.Fprintln(tw, strings.Join(line, "\t")+"\t")
+	}
+	return tw.Flush()
+}
+
+// WriteTable writes the report as human readable tables
+func (r *ContributionReport) WriteTable(w io.Writer) error {
+	fmt.Fprintf(w, "Guild stash contributions from %s to %s\n\n", r.Start.Format("2006-01-02 15:04"), r.End.Format("2006-01-02 15:04"))
+	err := r.writeSection(w, []string{"Account", "Tab"}, r.Rows, func(row ContributionRow) []string {
+		return []string{row.Account, row.Stash}
+	})
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintln(w, "\nTotals per account")
+	err = r.writeSection(w, []string{"Account", "Team"}, r.Accounts, func(row ContributionRow) []string {
+		return []string{row.Account, row.Team}
+	})
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintln(w, "\nTotals per tab")
+	err = r.writeSection(w, []string{"Tab"}, r.Tabs, func(row ContributionRow) []string {
+		return []string{row.Stash}
+	})
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintln(w, "\nTotals per day")
+	err = r.writeSection(w, []string{"Day"}, r.Days, func(row ContributionRow) []string {
+		return []string{row.Day}
+	})
+	if err != nil {
+		return err
+	}
+
+	if len(r.Unpriced) > 0 {
+		examples := r.Unpriced[:min(len(r.Unpriced), 10)]
+		fmt.Fprintf(w, "\nItems without a price count as 0 chaos (%d different items), most frequent: %s\n", len(r.Unpriced), strings.Join(examples, ", "))
+	}
+
+	if r.OwningTeam == "" {
+		return nil
+	}
+	var outsiders []ContributionRow
+	for _, row := range r.Rows {
+		if row.Outsider {
+			outsiders = append(outsiders, row)
+		}
+	}
+	if len(outsiders) == 0 {
+		fmt.Fprintf(w, "\nNo stash activity by accounts outside of %s\n", r.OwningTeam)
+		return nil
+	}
+	fmt.Fprintf(w, "\nStash activity by accounts outside of %s\n", r.OwningTeam)
+	return r.writeSection(w, []string{"Account", "Team", "Tab"}, outsiders, func(row ContributionRow) []string {
+		return []string{row.Account, row.Team, row.Stash}
+	})
+}
+
+// WriteCSV writes one line per account and tab, followed by the totals per account with an empty
+// tab, the totals per tab with an empty account and the totals per day
+func (r *ContributionReport) WriteCSV(w io.Writer) error {
+	writer := csv.NewWriter(w)
+	header := []string{"account", "tab", "added", "removed", "added_items", "removed_items", "team", "outsider", "day", "deposited_chaos", "withdrawn_chaos", "net_chaos"}
+	if err := writer.Write(header); err != nil {
+		return err
+	}
+	for _, row := range slices.Concat(r.Rows, r.Accounts, r.Tabs, r.Days) {
+		err := writer.Write([]string{
+			row.Account,
+			row.Stash,
+			strconv.Itoa(row.Added),
+			strconv.Itoa(row.Removed),
+			strconv.Itoa(row.AddedItems),
+			strconv.Itoa(row.RemovedItems),
+			row.Team,
+			strconv.FormatBool(row.Outsider),
+			row.Day,
+			strconv.FormatFloat(row.Deposited, 'f', -1, 64),
+			strconv.FormatFloat(row.Withdrawn, 'f', -1, 64),
+			strconv.FormatFloat(row.Net, 'f', -1, 64),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+func (r *ContributionReport) WriteJSON(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(r)
+}
+
+// Write writes the report in the given format: "table", "csv" or "json"
+func (r *ContributionReport) Write(w io.Writer, format string) error {
+	switch format {
+	case "table":
+		return r.WriteTable(w)
+	case "csv":
+		return r.WriteCSV(w)
+	case "json":
+		return r.WriteJSON(w)
+	default:
+		return fmt.Errorf("unknown report format: %s", format)
+	}
+}
+
+// RunContributionReport writes a contribution report for the stash history between start and
+// end. A zero start means the start of the league. The report is built from the local archive,
+// only the part of the window the archive doesn't cover is fetched from PoE. Nothing is
+// archived, uploaded or registered with the BPL backend.
+func RunContributionReport(sessionId, bplJwt string, options Options, start, end time.Time, format string, out io.Writer) error {
+	ctx := context.Background()
+	// Entries that are only fetched for the report must not end up in the archive, otherwise the
+	// monitor would consider them synced without ever uploading them
+	options.DryRun = true
+	client, _, err := newLocalClient(sessionId, bplJwt, options)
+	if err != nil {
+		return fmt.Errorf("error creating client: %w", err)
+	}
+	fetched := &MemorySink{}
+	client.sink = fetched
+	if start.IsZero() {
+		timestamps, err := client.getTimestamps()
+		if err != nil {
+			return fmt.Errorf("error getting league start: %w", err)
+		}
+		start = time.Unix(timestamps.LeagueStart, 0)
+	}
+
+	client.leagueStart, client.leagueEnd = start.Unix(), end.Unix()
+	for _, window := range client.uncoveredWindows(start.Unix(), end.Unix()) {
+		if _, _, err := client.getHistoryBetween(ctx, window[0], window[1], ""); err != nil {
+			return fmt.Errorf("error getting history: %w", err)
+		}
+		client.notify("Fetched the stash history from %s to %s that isn't archived yet",
+			time.Unix(window[1], 0).Format("2006-01-02 15:04"), time.Unix(window[0], 0).Format("2006-01-02 15:04"))
+	}
+	entries, err := client.archive.Entries(start.Unix(), end.Unix())
+	if err != nil {
+		return fmt.Errorf("error reading archive: %w", err)
+	}
+	for _, entry := range fetched.Entries() {
+		if !client.archive.Has(entry.Id) {
+			entries = append(entries, entry)
+		}
+	}
+	var prices *PriceTable
+	if options.PriceFile != "" {
+		prices, err = LoadPriceTable(options.PriceFile)
+		if errors.Is(err, os.ErrNotExist) {
+			fmt.Fprintf(os.Stderr, "No price file at %s, the report leaves out chaos values\n", options.PriceFile)
+		} else if err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: Could not load prices, the report leaves out chaos values: %v\n", err)
+		}
+	}
+	report := BuildContributionReport(entries, start.Unix(), end.Unix(), prices)
+	if resolver, err := client.loadTeamResolver(); err == nil {
+		report.FlagOutsiders(resolver)
+	} else {
+		fmt.Fprintf(os.Stderr, "Warning: Could not check stash activity against the owning team: %v\n", err)
+	}
+	if err := report.Write(out, format); err != nil {
+		return fmt.Errorf("error writing report: %w", err)
+	}
+	return nil
+}
+
+// uncoveredWindows returns the parts of start..end outside of the archived range as
+// [newest, oldest] pairs, the way history walks take them
+func (c *Client) uncoveredWindows(start, end int64) [][2]int64 {
+	earliest, latest, ok := c.archive.Bounds()
+	if !ok || latest < start || earliest > end {
+		return [][2]int64{{end, start}}
+	}
+	var windows [][2]int64
+	if latest < end {
+		windows = append(windows, [2]int64{end, latest})
+	}
+	if earliest > start {
+		windows = append(windows, [2]int64{earliest, start})
+	}
+	return windows
+}
@@ -0,0 +1,64 @@
+package guild_stash_logs
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestBuildContributionReport(t *testing.T) {
+	day1 := time.Date(2025, 6, 1, 0, 0, 0, 0, time.Local)
+	day2 := day1.AddDate(0, 0, 1)
+	entry := func(id string, at time.Time, action, account, stash, item string) GuildStashEntry {
+		entry := stashEntry(id, at.Unix(), action, account, item, 0, 0)
+		entry.Stash = stash
+		return entry
+	}
+	entries := []GuildStashEntry{
+		entry("1", day1.Add(10*time.Hour), "added", "alice", "Currency", "2x Divine Orb"),
+		entry("2", day1.Add(12*time.Hour), "removed", "Bob", "Currency", "Divine Orb"),
+		// Entries of a tab without a name must not be mixed up with the account totals
+		entry("3", day2.Add(9*time.Hour), "added", "alice", "", "10x Chaos Orb"),
+		entry("4", day2.Add(10*time.Hour), "added", "Bob", "Dump", "Unknown Thing"),
+		entry("5", day2.Add(30*time.Hour), "added", "alice", "Currency", "Divine Orb"),
+	}
+	prices := NewPriceTable(map[string]float64{"Divine Orb": 180})
+	report := BuildContributionReport(entries, day1.Unix(), day2.Add(24*time.Hour-time.Second).Unix(), prices)
+
+	tests := []struct {
+		name string
+		got  []ContributionRow
+		want []ContributionRow
+	}{
+		{"rows", report.Rows, []ContributionRow{
+			{Account: "alice", Added: 1, AddedItems: 10, Deposited: 10, Net: 10},
+			{Account: "alice", Stash: "Currency", Added: 1, AddedItems: 2, Deposited: 360, Net: 360},
+			{Account: "Bob", Stash: "Currency", Removed: 1, RemovedItems: 1, Withdrawn: 180, Net: -180},
+			{Account: "Bob", Stash: "Dump", Added: 1, AddedItems: 1},
+		}},
+		{"accounts", report.Accounts, []ContributionRow{
+			{Account: "alice", Added: 2, AddedItems: 12, Deposited: 370, Net: 370},
+			{Account: "Bob", Added: 1, Removed: 1, AddedItems: 1, RemovedItems: 1, Withdrawn: 180, Net: -180},
+		}},
+		{"tabs", report.Tabs, []ContributionRow{
+			{Added: 1, AddedItems: 10, Deposited: 10, Net: 10},
+			{Stash: "Currency", Added: 1, Removed: 1, AddedItems: 2, RemovedItems: 1, Deposited: 360, Withdrawn: 180, Net: 180},
+			{Stash: "Dump", Added: 1, AddedItems: 1},
+		}},
+		{"days", report.Days, []ContributionRow{
+			{Day: "2025-06-01", Added: 1, Removed: 1, AddedItems: 2, RemovedItems: 1, Deposited: 360, Withdrawn: 180, Net: 180},
+			{Day: "2025-06-02", Added: 2, AddedItems: 11, Deposited: 10, Net: 10},
+		}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if !slices.Equal(test.got, test.want) {
+				t.Errorf("%s = %+v, want %+v", test.name, test.got, test.want)
+			}
+		})
+	}
+	if want := []string{"Unknown Thing"}; !slices.Equal(report.Unpriced, want) {
+		t.Errorf("unpriced = %v, want %v", report.Unpriced, want)
+	}
+}
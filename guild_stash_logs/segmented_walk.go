@@ -0,0 +1,181 @@
+package guild_stash_logs
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// BackfillOptions configures how long history walks are split into segments
+type BackfillOptions struct {
+	// Workers is the number of segments fetched in parallel. All workers share the rate limiter
+	// of the session, 1 walks the whole window in one go.
+	Workers int
+	// SegmentLength is the time span of a segment
+	SegmentLength time.Duration
+}
+
+// segmentedWalk is the shared state of the workers of a segmented walk
+type segmentedWalk struct {
+	mutex      sync.Mutex
+	checkpoint *WalkCheckpoint
+	// persist is false for dry runs, which must not leave a checkpoint behind
+	persist bool
+	kind    walkKind
+	archive *StashArchive
+}
+
+// splitWalk splits the window from start back to end into segments of the given length.
+// Neighbouring segments share their boundary, entries seen twice are de-duplicated.
+func splitWalk(start, end int64, length time.Duration) []WalkSegment {
+	step := max(int64(length.Seconds()), 1)
+	var segments []WalkSegment
+	for segmentStart := start; segmentStart > end; segmentStart -= step {
+		segments = append(segments, WalkSegment{Start: segmentStart, End: max(segmentStart-step, end), Time: segmentStart})
+	}
+	return segments
+}
+
+// segment returns a copy of the segment at index
+func (w *segmentedWalk) segment(index int) WalkSegment {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.checkpoint.Segments[index]
+}
+
+// update changes the segment at index and checkpoints the walk
+func (w *segmentedWalk) update(index int, fn func(segment *WalkSegment)) error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	fn(&w.checkpoint.Segments[index])
+	if !w.persist {
+		return nil
+	}
+	if err := w.archive.SaveWalkCheckpoint(w.kind, w.checkpoint); err != nil {
+		return fmt.Errorf("failed to save walk checkpoint: %w", err)
+	}
+	return nil
+}
+
+// percent returns how much of the time span of all segments was walked
+func (w *segmentedWalk) percent() float64 {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	var total, done int64
+	for _, segment := range w.checkpoint.Segments {
+		total += segment.Start - segment.End
+		if segment.Done {
+			done += segment.Start - segment.End
+		} else {
+			done += min(max(segment.Start-segment.Time, 0), segment.Start-segment.End)
+		}
+	}
+	if total == 0 {
+		return 100
+	}
+	return float64(done) / float64(total) * 100
+}
+
+// remaining returns the number of segments that aren't done yet
+func (c *WalkCheckpoint) remaining() int {
+	remaining := 0
+	for _, segment := range c.Segments {
+		if !segment.Done {
+			remaining++
+		}
+	}
+	return remaining
+}
+
+// getHistorySegmented walks the stash history from start back to end like getHistoryBetween.
+// Windows longer than one segment are split into segments that Backfill.Workers fetch in
+// parallel, and every segment's cursor is checkpointed so an interrupted walk only repeats
+// the unfinished segments.
+func (c *Client) getHistorySegmented(ctx context.Context, start, end int64) error {
+	options := c.Options.Backfill
+	if options.Workers <= 1 || time.Duration(start-end)*time.Second <= options.SegmentLength {
+		_, _, err := c.getHistoryBetween(ctx, start, end, "")
+		return err
+	}
+	// Continue the checkpoint if it belongs to the same window. Walks that don't add to the
+	// archive start fresh, the segments a checkpoint marks as done aren't in their output.
+	var checkpoint *WalkCheckpoint
+	if !c.Options.DryRun {
+		saved, err := c.archive.WalkCheckpoint(c.walkKind)
+		if err != nil {
+			return err
+		}
+		if saved != nil && saved.Start == start && saved.End == end {
+			checkpoint = saved
+		}
+	}
+	if checkpoint == nil {
+		checkpoint = &WalkCheckpoint{Start: start, End: end, Segments: splitWalk(start, end, options.SegmentLength)}
+	}
+	return c.runSegmentedWalk(ctx, checkpoint)
+}
+
+// runSegmentedWalk fetches every unfinished segment of the checkpoint. The first error stops
+// all workers. The checkpoint is removed once every segment is done.
+func (c *Client) runSegmentedWalk(ctx context.Context, checkpoint *WalkCheckpoint) error {
+	walk := &segmentedWalk{checkpoint: checkpoint, persist: !c.Options.DryRun, kind: c.walkKind, archive: c.archive}
+	pending := make(chan int, len(checkpoint.Segments))
+	for i, segment := range checkpoint.Segments {
+		if !segment.Done {
+			pending <- i
+		}
+	}
+	close(pending)
+
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	c.startWalk()
+	c.mutex.Lock()
+	c.walk = walk
+	c.mutex.Unlock()
+	defer func() {
+		c.mutex.Lock()
+		c.walk = nil
+		c.mutex.Unlock()
+	}()
+
+	var wg sync.WaitGroup
+	for range min(max(c.Options.Backfill.Workers, 1), len(pending)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for index := range pending {
+				if err := c.walkSegment(ctx, walk, index); err != nil {
+					cancel(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if err := context.Cause(ctx); err != nil {
+		return err
+	}
+	if !walk.persist {
+		return nil
+	}
+	return c.archive.ClearWalkCheckpoint(walk.kind)
+}
+
+// walkSegment fetches a single segment, checkpointing it after every page
+func (c *Client) walkSegment(ctx context.Context, walk *segmentedWalk, index int) error {
+	segment := walk.segment(index)
+	paginator := c.NewHistoryPaginator(segment.Time, segment.End, segment.FromId)
+	err := c.storePages(paginator.Pages(ctx), func(page *HistoryPage) error {
+		return walk.update(index, func(segment *WalkSegment) {
+			segment.FromId, segment.Time = page.LastId, page.LastTime
+		})
+	})
+	if err != nil {
+		return err
+	}
+	return walk.update(index, func(segment *WalkSegment) {
+		segment.Done = true
+	})
+}
@@ -0,0 +1,72 @@
+package guild_stash_logs
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestSplitWalk(t *testing.T) {
+	tests := []struct {
+		name       string
+		start, end int64
+		length     time.Duration
+		want       []WalkSegment
+	}{
+		{"single segment", 100, 50, time.Hour, []WalkSegment{{Start: 100, End: 50, Time: 100}}},
+		{"exact segments", 300, 0, 100 * time.Second, []WalkSegment{
+			{Start: 300, End: 200, Time: 300},
+			{Start: 200, End: 100, Time: 200},
+			{Start: 100, End: 0, Time: 100},
+		}},
+		{"shorter last segment", 250, 0, 100 * time.Second, []WalkSegment{
+			{Start: 250, End: 150, Time: 250},
+			{Start: 150, End: 50, Time: 150},
+			{Start: 50, End: 0, Time: 50},
+		}},
+		{"length below a second", 3, 0, time.Millisecond, []WalkSegment{
+			{Start: 3, End: 2, Time: 3},
+			{Start: 2, End: 1, Time: 2},
+			{Start: 1, End: 0, Time: 1},
+		}},
+		{"empty window", 100, 100, time.Hour, nil},
+		{"reversed window", 50, 100, time.Hour, nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := splitWalk(test.start, test.end, test.length); !slices.Equal(got, test.want) {
+				t.Errorf("splitWalk(%d, %d, %v) = %v, want %v", test.start, test.end, test.length, got, test.want)
+			}
+		})
+	}
+}
+
+func TestSegmentedWalkPercent(t *testing.T) {
+	tests := []struct {
+		name     string
+		segments []WalkSegment
+		want     float64
+	}{
+		{"nothing walked", splitWalk(400, 0, 100*time.Second), 0},
+		{"one segment done", []WalkSegment{
+			{Start: 200, End: 100, Time: 100, Done: true},
+			{Start: 100, End: 0, Time: 100},
+		}, 50},
+		{"segments partially walked", []WalkSegment{
+			{Start: 200, End: 100, Time: 150},
+			{Start: 100, End: 0, Time: 75},
+		}, 37.5},
+		{"walked past the end", []WalkSegment{{Start: 100, End: 0, Time: -50}}, 100},
+		{"no segments", nil, 100},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			walk := &segmentedWalk{checkpoint: &WalkCheckpoint{Segments: test.segments}}
+			if got := walk.percent(); got != test.want {
+				t.Errorf("percent() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,179 @@
+package guild_stash_logs
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// StashSink is where the pages of a history walk end up
+type StashSink interface {
+	// Write hands over a page. Once it returns without error the sink is responsible for it.
+	Write(page *HistoryPage) error
+	// Start begins delivering pages in the background until the returned stop function is called
+	Start() (stop func())
+	// Flush waits until every page written so far is delivered or the timeout expires
+	Flush(timeout time.Duration) error
+}
+
+// BackendSink uploads pages to the BPL backend through the persistent upload queue
+type BackendSink struct {
+	Queue *UploadQueue
+	// Force sends entries again even if they were uploaded before
+	Force bool
+}
+
+func NewBackendSink(guildId int, bplJwt string) (*BackendSink, error) {
+	queue, err := NewUploadQueue(guildId, bplJwt)
+	if err != nil {
+		return nil, err
+	}
+	return &BackendSink{Queue: queue}, nil
+}
+
+func (s *BackendSink) Write(page *HistoryPage) error {
+	if s.Force {
+		return s.Queue.EnqueueForce(page.Body)
+	}
+	return s.Queue.Enqueue(page.Body)
+}
+
+func (s *BackendSink) Start() (stop func()) {
+	return s.Queue.Start()
+}
+
+func (s *BackendSink) Flush(timeout time.Duration) error {
+	return s.Queue.Drain(timeout)
+}
+
+// MemorySink keeps every entry in memory, for walks whose entries are only needed once
+type MemorySink struct {
+	mutex   sync.Mutex
+	entries []GuildStashEntry
+}
+
+func (s *MemorySink) Write(page *HistoryPage) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.entries = append(s.entries, page.Entries...)
+	return nil
+}
+
+func (s *MemorySink) Start() (stop func()) {
+	return func() {}
+}
+
+func (s *MemorySink) Flush(timeout time.Duration) error {
+	return nil
+}
+
+// Entries returns every entry written so far
+func (s *MemorySink) Entries() []GuildStashEntry {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return slices.Clone(s.entries)
+}
+
+// FileSink writes every entry to a local file instead of uploading it, either as JSON
+// lines or as CSV with the parsed item columns
+type FileSink struct {
+	Path   string
+	Format string
+
+	mutex  sync.Mutex
+	file   *os.File
+	writer *bufio.Writer
+	csv    *csv.Writer
+}
+
+func NewFileSink(path, format string) (*FileSink, error) {
+	if format != "jsonl" && format != "csv" {
+		return nil, fmt.Errorf("unknown export format: %s", format)
+	}
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create export file: %w", err)
+	}
+	sink := &FileSink{Path: path, Format: format, file: file, writer: bufio.NewWriter(file)}
+	if format == "csv" {
+		sink.csv = csv.NewWriter(sink.writer)
+		err := sink.csv.Write([]string{"id", "time", "league", "stash", "item", "action", "account", "x", "y", "stack_size", "name", "base_type", "rarity"})
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+	return sink, nil
+}
+
+func (s *FileSink) Write(page *HistoryPage) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, entry := range page.Entries {
+		if err := s.writeEntry(entry); err != nil {
+			return fmt.Errorf("failed to export stash history: %w", err)
+		}
+	}
+	return nil
+}
+
+func (s *FileSink) writeEntry(entry GuildStashEntry) error {
+	if s.csv == nil {
+		data, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		_, err = s.writer.Write(append(data, '\n'))
+		return err
+	}
+	return s.csv.Write([]string{
+		entry.Id,
+		time.Unix(entry.Time, 0).UTC().Format(time.RFC3339),
+		entry.League,
+		entry.Stash,
+		entry.Item,
+		entry.Action,
+		entry.Account.Name,
+		strconv.Itoa(entry.X),
+		strconv.Itoa(entry.Y),
+		strconv.Itoa(entry.Parsed.StackSize),
+		entry.Parsed.Name,
+		entry.Parsed.BaseType,
+		string(entry.Parsed.Rarity),
+	})
+}
+
+// Start has nothing to deliver in the background. The returned stop function closes the file.
+func (s *FileSink) Start() (stop func()) {
+	return func() {
+		if err := s.Flush(0); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: %v\n", err)
+		}
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		s.file.Close()
+	}
+}
+
+func (s *FileSink) Flush(timeout time.Duration) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.csv != nil {
+		s.csv.Flush()
+		if err := s.csv.Error(); err != nil {
+			return fmt.Errorf("failed to write %s: %w", s.Path, err)
+		}
+	}
+	if err := s.writer.Flush(); err != nil {
+		return fmt.Errorf("failed to write %s: %w", s.Path, err)
+	}
+	return nil
+}
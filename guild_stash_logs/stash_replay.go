@@ -0,0 +1,383 @@
+package guild_stash_logs
+
+import (
+	"cmp"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// TabItem is an item the replay believes to be in a stash tab. X and Y are the top left cell
+// of the item.
+type TabItem struct {
+	Stash     string `json:"stash"`
+	X         int    `json:"x"`
+	Y         int    `json:"y"`
+	Item      string `json:"item"`
+	StackSize int    `json:"stack_size"`
+	// Account and Time belong to the entry that last added to the item
+	Account string `json:"account"`
+	Time    int64  `json:"time"`
+}
+
+func (i TabItem) String() string {
+	if i.StackSize > 1 {
+		return fmt.Sprintf("%dx %s", i.StackSize, i.Item)
+	}
+	return i.Item
+}
+
+// UnaccountedItem is an item the stash history doesn't explain: it was removed without ever
+// being added, e.g. because it was in the tab before the history starts, or it disappeared
+// from its cell without being removed.
+type UnaccountedItem struct {
+	TabItem
+	Reason string `json:"reason"`
+}
+
+// ReplayWarning is an entry that conflicts with the reconstructed state of its tab
+type ReplayWarning struct {
+	Time    int64  `json:"time"`
+	EntryId string `json:"entry_id"`
+	Stash   string `json:"stash"`
+	Message string `json:"message"`
+}
+
+func (w ReplayWarning) String() string {
+	return fmt.Sprintf("%s %s: %s", time.Unix(w.Time, 0).Format("2006-01-02 15:04"), w.Stash, w.Message)
+}
+
+type gridCell struct {
+	stash string
+	x, y  int
+}
+
+// StashReplay folds stash history entries into the contents of every tab. Entries have to be
+// applied oldest first.
+type StashReplay struct {
+	items map[gridCell]*TabItem
+	// emptied are the cells whose item was removed, a second removal from them is impossible
+	emptied     map[gridCell]bool
+	seen        map[string]bool
+	time        int64
+	Unaccounted []UnaccountedItem
+	Warnings    []ReplayWarning
+}
+
+func NewStashReplay() *StashReplay {
+	return &StashReplay{
+		items:   make(map[gridCell]*TabItem),
+		emptied: make(map[gridCell]bool),
+		seen:    make(map[string]bool),
+	}
+}
+
+// ReplayUntil replays all entries up to and including at, no matter in which order they are given
+func ReplayUntil(entries []GuildStashEntry, at int64) *StashReplay {
+	sorted := slices.Clone(entries)
+	slices.SortStableFunc(sorted, func(a, b GuildStashEntry) int {
+		return cmp.Or(cmp.Compare(a.Time, b.Time), cmp.Compare(a.Id, b.Id))
+	})
+	replay := NewStashReplay()
+	for _, entry := range sorted {
+		if entry.Time > at {
+			break
+		}
+		replay.Apply(entry)
+	}
+	return replay
+}
+
+// stackName returns the item string without its stack size, e.g. "Chaos Orb" for "20x Chaos Orb"
+func stackName(item string) string {
+	if match := stackSizeRegex.FindStringSubmatch(item); match != nil {
+		return match[2]
+	}
+	return item
+}
+
+func (r *StashReplay) warn(entry GuildStashEntry, format string, args ...any) {
+	r.Warnings = append(r.Warnings, ReplayWarning{
+		Time:    entry.Time,
+		EntryId: entry.Id,
+		Stash:   entry.Stash,
+		Message: fmt.Sprintf(format, args...),
+	})
+}
+
+func (r *StashReplay) unaccounted(item TabItem, reason string) {
+	r.Unaccounted = append(r.Unaccounted, UnaccountedItem{TabItem: item, Reason: reason})
+}
+
+// Apply folds a single entry into the state. Entries that were applied before are ignored.
+func (r *StashReplay) Apply(entry GuildStashEntry) {
+	if r.seen[entry.Id] {
+		return
+	}
+	r.seen[entry.Id] = true
+	if entry.Time < r.time {
+		r.warn(entry, "entry %s is older than entries replayed before it", entry.Id)
+	}
+	r.time = max(r.time, entry.Time)
+
+	cell := gridCell{entry.Stash, entry.X, entry.Y}
+	item := TabItem{
+		Stash:     entry.Stash,
+		X:         entry.X,
+		Y:         entry.Y,
+		Item:      stackName(entry.Item),
+		StackSize: max(entry.Parsed.StackSize, 1),
+		Account:   entry.Account.Name,
+		Time:      entry.Time,
+	}
+	held := r.items[cell]
+	switch entry.Action {
+	case "added":
+		switch {
+		case held == nil:
+			r.items[cell] = &item
+		case held.Item == item.Item && (entry.Parsed.Rarity == RarityCurrency || entry.Parsed.Rarity == RarityDivination):
+			// Added onto a stack of the same kind
+			held.StackSize += item.StackSize
+			held.Account, held.Time = item.Account, item.Time
+		default:
+			r.warn(entry, "%s added at %d,%d, which still holds %s", item, item.X, item.Y, held)
+			r.unaccounted(*held, fmt.Sprintf("replaced by %s without being removed", item))
+			r.items[cell] = &item
+		}
+		delete(r.emptied, cell)
+	case "removed":
+		switch {
+		case held == nil:
+			if r.emptied[cell] {
+				r.warn(entry, "%s removed from %d,%d, which was already emptied", item, item.X, item.Y)
+			}
+			r.unaccounted(item, fmt.Sprintf("removed by %s without being added", item.Account))
+		case held.Item != item.Item:
+			r.warn(entry, "%s removed from %d,%d, which holds %s", item, item.X, item.Y, held)
+			r.unaccounted(*held, fmt.Sprintf("gone when %s was removed from its cell", item))
+			delete(r.items, cell)
+			r.emptied[cell] = true
+		case item.StackSize < held.StackSize:
+			held.StackSize -= item.StackSize
+		default:
+			if item.StackSize > held.StackSize {
+				r.warn(entry, "%s removed from %d,%d, which only holds %s", item, item.X, item.Y, held)
+				excess := item
+				excess.StackSize -= held.StackSize
+				r.unaccounted(excess, fmt.Sprintf("removed by %s without being added", item.Account))
+			}
+			delete(r.items, cell)
+			r.emptied[cell] = true
+		}
+	case "modified":
+		r.items[cell] = &item
+		delete(r.emptied, cell)
+	default:
+		r.warn(entry, "unknown action %q", entry.Action)
+	}
+}
+
+// Tabs returns the names of all tabs that hold items, sorted
+func (r *StashReplay) Tabs() []string {
+	var tabs []string
+	for cell := range r.items {
+		if !slices.Contains(tabs, cell.stash) {
+			tabs = append(tabs, cell.stash)
+		}
+	}
+	slices.Sort(tabs)
+	return tabs
+}
+
+// Tab returns the items of a tab, or of all tabs if stash is empty, ordered by tab and position
+func (r *StashReplay) Tab(stash string) []TabItem {
+	var items []TabItem
+	for cell, item := range r.items {
+		if stash == "" || strings.EqualFold(cell.stash, stash) {
+			items = append(items, *item)
+		}
+	}
+	slices.SortFunc(items, func(a, b TabItem) int {
+		return cmp.Or(strings.Compare(a.Stash, b.Stash), cmp.Compare(a.Y, b.Y), cmp.Compare(a.X, b.X))
+	})
+	return items
+}
+
+// StashSnapshot is what the replay knows about a tab, or all tabs, at a point in time
+type StashSnapshot struct {
+	Time        time.Time         `json:"time"`
+	Stash       string            `json:"stash,omitempty"`
+	Items       []TabItem         `json:"items"`
+	Unaccounted []UnaccountedItem `json:"unaccounted"`
+	Warnings    []ReplayWarning   `json:"warnings"`
+}
+
+// Snapshot returns the current state of a tab, or of all tabs if stash is empty
+func (r *StashReplay) Snapshot(stash string) *StashSnapshot {
+	snapshot := &StashSnapshot{Time: time.Unix(r.time, 0), Stash: stash, Items: r.Tab(stash)}
+	for _, item := range r.Unaccounted {
+		if stash == "" || strings.EqualFold(item.Stash, stash) {
+			snapshot.Unaccounted = append(snapshot.Unaccounted, item)
+		}
+	}
+	for _, warning := range r.Warnings {
+		if stash == "" || strings.EqualFold(warning.Stash, stash) {
+			snapshot.Warnings = append(snapshot.Warnings, warning)
+		}
+	}
+	return snapshot
+}
+
+// WriteTable writes the snapshot as human readable tables
+func (s *StashSnapshot) WriteTable(w io.Writer) error {
+	tab := s.Stash
+	if tab == "" {
+		tab = "all tabs"
+	}
+	fmt.Fprintf(w, "Contents of %s at %s\n\n", tab, s.Time.Format("2006-01-02 15:04"))
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "Tab\tX\tY\tItem\tAdded by\tAdded at\t")
+	for _, item := range s.Items {
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%s\t%s\t%s\t\n", item.Stash, item.X, item.Y, item, item.Account, time.Unix(item.Time, 0).Format("2006-01-02 15:04"))
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	if len(s.Unaccounted) > 0 {
+		fmt.Fprintln(w, "\nUnaccounted items")
+		tw = tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "Tab\tX\tY\tItem\tTime\tReason\t")
+		for _, item := range s.Unaccounted {
+			fmt.Fprintf(tw, "%s\t%d\t%d\t%s\t%s\t%s\t\n", item.Stash, item.X, item.Y, item.TabItem, time.Unix(item.Time, 0).Format("2006-01-02 15:04"), item.Reason)
+		}
+		if err := tw.Flush(); err != nil {
+			return err
+		}
+	}
+	if len(s.Warnings) > 0 {
+		fmt.Fprintln(w, "\nWarnings")
+		for _, warning := range s.Warnings {
+			fmt.Fprintln(w, warning)
+		}
+	}
+	return nil
+}
+
+// WriteCSV writes one line per item, with unaccounted items marked in the status column
+func (s *StashSnapshot) WriteCSV(w io.Writer) error {
+	writer := csv.NewWriter(w)
+	if err := writer.Write([]string{"status", "tab", "x", "y", "item", "stack_size", "account", "time", "reason"}); err != nil {
+		return err
+	}
+	write := func(status string, item TabItem, reason string) error {
+		return writer.Write([]string{
+			status,
+			item.Stash,
+			strconv.Itoa(item.X),
+			strconv.Itoa(item.Y),
+			item.Item,
+			strconv.Itoa(item.StackSize),
+			item.Account,
+			time.Unix(item.Time, 0).UTC().Format(time.RFC3339),
+			reason,
+		})
+	}
+	for _, item := range s.Items {
+		if err := write("in_tab", item, ""); err != nil {
+			return err
+		}
+	}
+	for _, item := range s.Unaccounted {
+		if err := write("unaccounted", item.TabItem, item.Reason); err != nil {
+			return err
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+func (s *StashSnapshot) WriteJSON(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(s)
+}
+
+// Write writes the snapshot in the given format: "table", "csv" or "json"
+func (s *StashSnapshot) Write(w io.Writer, format string) error {
+	switch format {
+	case "table":
+		return s.WriteTable(w)
+	case "csv":
+		return s.WriteCSV(w)
+	case "json":
+		return s.WriteJSON(w)
+	default:
+		return fmt.Errorf("unknown report format: %s", format)
+	}
+}
+
+// openLocalArchive opens the archive of guildId. Without a guild id it opens the only archive
+// there is, so a single guild setup doesn't need GUILD_ID.
+func openLocalArchive(guildId int) (*StashArchive, error) {
+	if guildId == 0 {
+		dirs, err := filepath.Glob(filepath.Join(archiveDir, "*"))
+		if err != nil {
+			return nil, err
+		}
+		var ids []int
+		for _, dir := range dirs {
+			if id, err := strconv.Atoi(filepath.Base(dir)); err == nil {
+				ids = append(ids, id)
+			}
+		}
+		switch len(ids) {
+		case 0:
+			return nil, fmt.Errorf("no stash history in %s yet, run the Guild Stash Monitor first", archiveDir)
+		case 1:
+			guildId = ids[0]
+		default:
+			return nil, fmt.Errorf("%s holds the history of %d guilds, set GUILD_ID to pick one", archiveDir, len(ids))
+		}
+	} else if _, err := os.Stat(filepath.Join(archiveDir, strconv.Itoa(guildId))); err != nil {
+		return nil, fmt.Errorf("no stash history for guild %d in %s yet, run the Guild Stash Monitor first", guildId, archiveDir)
+	}
+	return OpenStashArchive(guildId)
+}
+
+// RunStashReplay reconstructs the contents of a tab, or of all tabs if stash is empty, at the
+// given time from the local archive and writes them together with the unaccounted items and
+// warnings. Only history that was synced before is taken into account.
+func RunStashReplay(options Options, at time.Time, stash string, format string, out io.Writer) error {
+	archive, err := openLocalArchive(options.GuildId)
+	if err != nil {
+		return err
+	}
+	earliest, _, ok := archive.Bounds()
+	if !ok {
+		return fmt.Errorf("the local archive is empty, run the Guild Stash Monitor first")
+	}
+	entries, err := archive.Entries(earliest, at.Unix())
+	if err != nil {
+		return fmt.Errorf("error reading archive: %w", err)
+	}
+	replay := ReplayUntil(entries, at.Unix())
+	if stash != "" && !slices.ContainsFunc(replay.Tabs(), func(tab string) bool { return strings.EqualFold(tab, stash) }) {
+		fmt.Fprintf(os.Stderr, "Warning: No items in a tab called %q at that time. Known tabs: %s\n", stash, strings.Join(replay.Tabs(), ", "))
+	}
+	snapshot := replay.Snapshot(stash)
+	snapshot.Time = at
+	if err := snapshot.Write(out, format); err != nil {
+		return fmt.Errorf("error writing replay: %w", err)
+	}
+	return nil
+}
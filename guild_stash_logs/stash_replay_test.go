@@ -0,0 +1,111 @@
+package guild_stash_logs
+
+import (
+	"slices"
+	"testing"
+)
+
+// stashEntry returns an entry of the "Currency" tab at the given cell
+func stashEntry(id string, time int64, action, account, item string, x, y int) GuildStashEntry {
+	entry := GuildStashEntry{Id: id, Time: time, Stash: "Currency", Item: item, Action: action, X: x, Y: y}
+	entry.Account.Name = account
+	entry.Parsed = ParseItem(item)
+	return entry
+}
+
+func TestStashReplayApply(t *testing.T) {
+	tests := []struct {
+		name            string
+		entries         []GuildStashEntry
+		wantItems       []TabItem
+		wantUnaccounted []UnaccountedItem
+		wantWarnings    int
+	}{
+		{
+			name: "stack merge",
+			entries: []GuildStashEntry{
+				stashEntry("1", 1, "added", "a", "10x Chaos Orb", 0, 0),
+				stashEntry("2", 2, "added", "b", "5x Chaos Orb", 0, 0),
+			},
+			wantItems: []TabItem{{Stash: "Currency", Item: "Chaos Orb", StackSize: 15, Account: "b", Time: 2}},
+		},
+		{
+			name: "partial removal",
+			entries: []GuildStashEntry{
+				stashEntry("1", 1, "added", "a", "20x Chaos Orb", 0, 0),
+				stashEntry("2", 2, "removed", "b", "5x Chaos Orb", 0, 0),
+			},
+			wantItems: []TabItem{{Stash: "Currency", Item: "Chaos Orb", StackSize: 15, Account: "a", Time: 1}},
+		},
+		{
+			name: "removal of more than the stack holds",
+			entries: []GuildStashEntry{
+				stashEntry("1", 1, "added", "a", "5x Chaos Orb", 0, 0),
+				stashEntry("2", 2, "removed", "b", "8x Chaos Orb", 0, 0),
+			},
+			wantUnaccounted: []UnaccountedItem{
+				{TabItem{Stash: "Currency", Item: "Chaos Orb", StackSize: 3, Account: "b", Time: 2}, "removed by b without being added"},
+			},
+			wantWarnings: 1,
+		},
+		{
+			name: "double removal",
+			entries: []GuildStashEntry{
+				stashEntry("1", 1, "added", "a", "Headhunter Leather Belt", 1, 2),
+				stashEntry("2", 2, "removed", "b", "Headhunter Leather Belt", 1, 2),
+				stashEntry("3", 3, "removed", "c", "Headhunter Leather Belt", 1, 2),
+			},
+			wantUnaccounted: []UnaccountedItem{
+				{TabItem{Stash: "Currency", X: 1, Y: 2, Item: "Headhunter Leather Belt", StackSize: 1, Account: "c", Time: 3}, "removed by c without being added"},
+			},
+			wantWarnings: 1,
+		},
+		{
+			name: "add onto an occupied cell",
+			entries: []GuildStashEntry{
+				stashEntry("1", 1, "added", "a", "Headhunter Leather Belt", 1, 2),
+				stashEntry("2", 2, "added", "b", "Mageblood Heavy Belt", 1, 2),
+			},
+			wantItems: []TabItem{{Stash: "Currency", X: 1, Y: 2, Item: "Mageblood Heavy Belt", StackSize: 1, Account: "b", Time: 2}},
+			wantUnaccounted: []UnaccountedItem{
+				{TabItem{Stash: "Currency", X: 1, Y: 2, Item: "Headhunter Leather Belt", StackSize: 1, Account: "a", Time: 1}, "replaced by Mageblood Heavy Belt without being removed"},
+			},
+			wantWarnings: 1,
+		},
+		{
+			name: "removal without an add",
+			entries: []GuildStashEntry{
+				stashEntry("1", 1, "removed", "a", "3x Divine Orb", 4, 0),
+			},
+			wantUnaccounted: []UnaccountedItem{
+				{TabItem{Stash: "Currency", X: 4, Item: "Divine Orb", StackSize: 3, Account: "a", Time: 1}, "removed by a without being added"},
+			},
+		},
+		{
+			name: "duplicate entry",
+			entries: []GuildStashEntry{
+				stashEntry("1", 1, "added", "a", "10x Chaos Orb", 0, 0),
+				stashEntry("1", 1, "added", "a", "10x Chaos Orb", 0, 0),
+			},
+			wantItems: []TabItem{{Stash: "Currency", Item: "Chaos Orb", StackSize: 10, Account: "a", Time: 1}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			replay := NewStashReplay()
+			for _, entry := range test.entries {
+				replay.Apply(entry)
+			}
+			if items := replay.Tab(""); !slices.Equal(items, test.wantItems) {
+				t.Errorf("items = %+v, want %+v", items, test.wantItems)
+			}
+			if !slices.Equal(replay.Unaccounted, test.wantUnaccounted) {
+				t.Errorf("unaccounted = %+v, want %+v", replay.Unaccounted, test.wantUnaccounted)
+			}
+			if len(replay.Warnings) != test.wantWarnings {
+				t.Errorf("warnings = %v, want %d", replay.Warnings, test.wantWarnings)
+			}
+		})
+	}
+}
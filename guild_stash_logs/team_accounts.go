@@ -0,0 +1,119 @@
+package guild_stash_logs
+
+import (
+	"fmt"
+
+	"tools/check_player_characters"
+	"tools/league_invites"
+)
+
+// AccountTeam is the BPL team behind a PoE account
+type AccountTeam struct {
+	// TeamId is 0 if the account isn't signed up for any team
+	TeamId   int    `json:"team_id,omitempty"`
+	TeamName string `json:"team_name,omitempty"`
+}
+
+func (a AccountTeam) String() string {
+	if a.TeamId == 0 {
+		return "not signed up"
+	}
+	return a.TeamName
+}
+
+// TeamResolver resolves the account names of stash entries to BPL teams
+type TeamResolver struct {
+	// teams maps normalized account names to the id of their team
+	teams map[string]int
+	names map[int]string
+	// OwningTeam is the id of the team that owns the guild, nil if it's unknown
+	OwningTeam *int
+}
+
+// NewTeamResolver indexes the signed up players by account name. The owning team is the team
+// most of the guild's members are on.
+func NewTeamResolver(signups []league_invites.Player, members []GuildMember) *TeamResolver {
+	resolver := &TeamResolver{teams: make(map[string]int), names: make(map[int]string)}
+	for _, player := range signups {
+		if player.TeamID != nil {
+			resolver.teams[normalizeAccountName(player.User.AccountName)] = *player.TeamID
+		}
+	}
+	resolver.OwningTeam = pluralityTeam(members, resolver.teams)
+	return resolver
+}
+
+// nameTeams sets the names of the teams. Teams without a name are shown by their id.
+func (r *TeamResolver) nameTeams(teams []check_player_characters.Team) {
+	for _, team := range teams {
+		r.names[team.ID] = team.Name
+	}
+}
+
+// TeamName returns the name of a team
+func (r *TeamResolver) TeamName(teamId int) string {
+	if name, ok := r.names[teamId]; ok {
+		return name
+	}
+	return fmt.Sprintf("team %d", teamId)
+}
+
+// Resolve returns the team of an account. Accounts that aren't signed up resolve to an
+// AccountTeam with TeamId 0.
+func (r *TeamResolver) Resolve(accountName string) AccountTeam {
+	teamId, ok := r.teams[normalizeAccountName(accountName)]
+	if !ok {
+		return AccountTeam{}
+	}
+	return AccountTeam{TeamId: teamId, TeamName: r.TeamName(teamId)}
+}
+
+// IsOutsider reports whether the account is not on the team that owns the guild. Nobody is an
+// outsider while the owning team is unknown.
+func (r *TeamResolver) IsOutsider(accountName string) bool {
+	return r.OwningTeam != nil && r.Resolve(accountName).TeamId != *r.OwningTeam
+}
+
+// loadTeamResolver returns the resolver of the roster sync, building it from the roster and
+// signups if the sync didn't run, and names its teams
+func (c *Client) loadTeamResolver() (*TeamResolver, error) {
+	resolver := c.teams
+	if resolver == nil {
+		members, err := FetchGuildRoster(c.SessionId, c.GuildId)
+		if err != nil {
+			return nil, err
+		}
+		signups, err := c.fetchSignups()
+		if err != nil {
+			return nil, err
+		}
+		resolver = NewTeamResolver(signups, members)
+	}
+	if resolver.OwningTeam == nil {
+		return nil, fmt.Errorf("none of the guild's members is signed up for a team")
+	}
+	teams, err := check_player_characters.FetchTeams()
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch teams: %w", err)
+	}
+	resolver.nameTeams(teams)
+	return resolver, nil
+}
+
+// OutsiderActivityRule alerts on every stash interaction by an account that isn't signed up
+// for the team that owns the guild
+type OutsiderActivityRule struct {
+	Resolver *TeamResolver
+}
+
+func (r *OutsiderActivityRule) Name() string {
+	return "outsider activity"
+}
+
+func (r *OutsiderActivityRule) Check(entry GuildStashEntry) (string, bool) {
+	if !r.Resolver.IsOutsider(entry.Account.Name) {
+		return "", false
+	}
+	return fmt.Sprintf("%s (%s) %s %s in %s, the guild belongs to %s",
+		entry.Account.Name, r.Resolver.Resolve(entry.Account.Name), entry.Action, entry.Item, entry.Stash, r.Resolver.TeamName(*r.Resolver.OwningTeam)), true
+}
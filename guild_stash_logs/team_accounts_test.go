@@ -0,0 +1,98 @@
+package guild_stash_logs
+
+import (
+	"testing"
+
+	"tools/check_player_characters"
+	"tools/league_invites"
+)
+
+// signup returns a player signed up for teamId, or for no team if teamId is 0
+func signup(accountName string, teamId int) league_invites.Player {
+	player := league_invites.Player{User: league_invites.User{AccountName: accountName}}
+	if teamId != 0 {
+		player.TeamID = &teamId
+	}
+	return player
+}
+
+// testResolver returns a resolver for a guild owned by "Team One"
+func testResolver() *TeamResolver {
+	signups := []league_invites.Player{
+		signup("Alice#1234", 1),
+		signup("Bob", 1),
+		signup("Carol", 2),
+		signup("Dave", 0),
+	}
+	members := []GuildMember{{AccountName: "Alice-1234"}, {AccountName: "Bob"}, {AccountName: "Carol"}, {AccountName: "Dave"}}
+	resolver := NewTeamResolver(signups, members)
+	resolver.nameTeams([]check_player_characters.Team{{ID: 1, Name: "Team One"}, {ID: 2, Name: "Team Two"}})
+	return resolver
+}
+
+func TestTeamResolverIsOutsider(t *testing.T) {
+	unknownOwner := NewTeamResolver([]league_invites.Player{signup("Carol", 2)}, []GuildMember{{AccountName: "Alice-1234"}})
+	tests := []struct {
+		name     string
+		resolver *TeamResolver
+		account  string
+		want     bool
+	}{
+		{"member of the owning team", testResolver(), "Bob", false},
+		{"discriminator and case differ", testResolver(), "alice#1234", false},
+		{"other team", testResolver(), "Carol", true},
+		{"signed up without a team", testResolver(), "Dave", true},
+		{"not signed up", testResolver(), "Mallory", true},
+		{"owning team unknown", unknownOwner, "Carol", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := test.resolver.IsOutsider(test.account); got != test.want {
+				t.Errorf("IsOutsider(%q) = %v, want %v", test.account, got, test.want)
+			}
+		})
+	}
+}
+
+func TestFlagOutsiders(t *testing.T) {
+	entries := []GuildStashEntry{
+		stashEntry("1", 10, "added", "Alice#1234", "10x Chaos Orb", 0, 0),
+		stashEntry("2", 20, "removed", "Carol", "5x Chaos Orb", 0, 0),
+		stashEntry("3", 30, "added", "Mallory", "Divine Orb", 1, 0),
+	}
+	report := BuildContributionReport(entries, 0, 100, nil)
+	report.FlagOutsiders(testResolver())
+
+	if report.OwningTeam != "Team One" {
+		t.Errorf("OwningTeam = %q, want %q", report.OwningTeam, "Team One")
+	}
+	tests := []struct {
+		account      string
+		wantTeam     string
+		wantOutsider bool
+	}{
+		{"Alice#1234", "Team One", false},
+		{"Carol", "Team Two", true},
+		{"Mallory", "not signed up", true},
+	}
+	for _, test := range tests {
+		t.Run(test.account, func(t *testing.T) {
+			for _, rows := range [][]ContributionRow{report.Rows, report.Accounts} {
+				found := false
+				for _, row := range rows {
+					if row.Account != test.account {
+						continue
+					}
+					found = true
+					if row.Team != test.wantTeam || row.Outsider != test.wantOutsider {
+						t.Errorf("row %+v has team %q and outsider %v, want %q and %v", row, row.Team, row.Outsider, test.wantTeam, test.wantOutsider)
+					}
+				}
+				if !found {
+					t.Errorf("no row for %s", test.account)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,571 @@
+package guild_stash_logs
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var uploadQueueDir = "bpl-upload-queue"
+
+// queuedUpload is a page of stash history that has not yet been accepted by the BPL backend
+type queuedUpload struct {
+	Id          string          `json:"id"`
+	GuildId     int             `json:"guild_id"`
+	Body        json.RawMessage `json:"body"`
+	Attempts    int             `json:"attempts"`
+	NextAttempt time.Time       `json:"next_attempt"`
+	LastError   string          `json:"last_error,omitempty"`
+	CreatedAt   time.Time       `json:"created_at"`
+	// Force sends the entries even if they were uploaded before
+	Force bool `json:"force,omitempty"`
+}
+
+// UploadQueue persists stash history pages on disk and retries them with exponential
+// backoff until the BPL backend accepts them. Pages that keep failing are moved to a
+// dead-letter file from where they can be replayed later. Entries that were uploaded
+// before are stripped, and due pages are combined into batches of up to BatchSize entries.
+type UploadQueue struct {
+	GuildId     int
+	BplJwt      string
+	MaxAttempts int
+	BaseBackoff time.Duration
+	MaxBackoff  time.Duration
+	BatchSize   int
+	// Notify reports what happens to uploads in the background, e.g. through the progress
+	// reporter of the client. Defaults to stderr.
+	Notify func(format string, args ...any)
+
+	dir string
+	// mutex guards the queue files and uploaded, sending makes sure only one processDue runs at a time
+	mutex    sync.Mutex
+	sending  sync.Mutex
+	counter  int
+	wake     chan struct{}
+	uploaded map[string]struct{}
+}
+
+func NewUploadQueue(guildId int, bplJwt string) (*UploadQueue, error) {
+	dir := filepath.Join(uploadQueueDir, strconv.Itoa(guildId))
+	if err := os.MkdirAll(filepath.Join(dir, "pending"), 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create upload queue directory: %w", err)
+	}
+	queue := &UploadQueue{
+		GuildId:     guildId,
+		BplJwt:      bplJwt,
+		MaxAttempts: 8,
+		BaseBackoff: 5 * time.Second,
+		MaxBackoff:  10 * time.Minute,
+		BatchSize:   1000,
+		Notify:      notifyStderr,
+		dir:         dir,
+		wake:        make(chan struct{}, 1),
+		uploaded:    make(map[string]struct{}),
+	}
+	if err := queue.loadUploadedIds(); err != nil {
+		return nil, fmt.Errorf("failed to read uploaded entry ids: %w", err)
+	}
+	return queue, nil
+}
+
+// notifyStderr writes a message of a queue without a client to stderr
+func notifyStderr(format string, args ...any) {
+	fmt.Fprintf(os.Stderr, format+"\n", args...)
+}
+
+func (q *UploadQueue) pendingDir() string {
+	return filepath.Join(q.dir, "pending")
+}
+
+func (q *UploadQueue) deadLetterPath() string {
+	return filepath.Join(q.dir, "dead-letter.jsonl")
+}
+
+func (q *UploadQueue) uploadedIdsPath() string {
+	return filepath.Join(q.dir, "uploaded-ids.txt")
+}
+
+func (q *UploadQueue) loadUploadedIds() error {
+	file, err := os.Open(q.uploadedIdsPath())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if id := strings.TrimSpace(scanner.Text()); id != "" {
+			q.uploaded[id] = struct{}{}
+		}
+	}
+	return scanner.Err()
+}
+
+// markUploaded remembers ids the backend has accepted, so they are never sent again
+func (q *UploadQueue) markUploaded(ids []string) error {
+	file, err := os.OpenFile(q.uploadedIdsPath(), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(file)
+	for _, id := range ids {
+		writer.WriteString(id + "\n")
+		q.uploaded[id] = struct{}{}
+	}
+	if err := writer.Flush(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// pageEntries returns the raw entries of a PoE stash history page together with their ids
+func pageEntries(body []byte) ([]json.RawMessage, []string, error) {
+	var page struct {
+		Entries []json.RawMessage `json:"entries"`
+	}
+	if err := json.Unmarshal(body, &page); err != nil {
+		return nil, nil, err
+	}
+	ids := make([]string, len(page.Entries))
+	for i, entry := range page.Entries {
+		var identified struct {
+			Id string `json:"id"`
+		}
+		if err := json.Unmarshal(entry, &identified); err != nil {
+			return nil, nil, err
+		}
+		ids[i] = identified.Id
+	}
+	return page.Entries, ids, nil
+}
+
+// encodePage builds a stash history page in the format PoE returns it
+func encodePage(entries []json.RawMessage) ([]byte, error) {
+	return json.Marshal(map[string]any{
+		"entries":   entries,
+		"truncated": false,
+	})
+}
+
+// freshEntries drops every entry that is in skip or, unless force is set, was already uploaded.
+// The ids of the remaining entries are added to skip.
+func (q *UploadQueue) freshEntries(body []byte, skip map[string]struct{}, force bool) ([]json.RawMessage, []string, error) {
+	entries, ids, err := pageEntries(body)
+	if err != nil {
+		return nil, nil, err
+	}
+	var fresh []json.RawMessage
+	var freshIds []string
+	for i, id := range ids {
+		if _, ok := q.uploaded[id]; ok && !force {
+			continue
+		}
+		if _, ok := skip[id]; ok {
+			continue
+		}
+		skip[id] = struct{}{}
+		fresh = append(fresh, entries[i])
+		freshIds = append(freshIds, id)
+	}
+	return fresh, freshIds, nil
+}
+
+// Enqueue stores the entries of a page that weren't uploaded yet on disk. Once it returns
+// without error the page survives a crash.
+func (q *UploadQueue) Enqueue(body []byte) error {
+	return q.enqueue(body, false)
+}
+
+// EnqueueForce is Enqueue for pages that are sent again even if they were uploaded before
+func (q *UploadQueue) EnqueueForce(body []byte) error {
+	return q.enqueue(body, true)
+}
+
+func (q *UploadQueue) enqueue(body []byte, force bool) error {
+	q.mutex.Lock()
+	entries, _, err := q.freshEntries(body, make(map[string]struct{}), force)
+	if err == nil && len(entries) > 0 {
+		body, err = encodePage(entries)
+	}
+	if err != nil {
+		q.mutex.Unlock()
+		return fmt.Errorf("failed to parse stash history page: %w", err)
+	}
+	if len(entries) == 0 {
+		q.mutex.Unlock()
+		return nil
+	}
+	q.counter++
+	now := time.Now()
+	upload := &queuedUpload{
+		Id:          fmt.Sprintf("%d-%06d", now.UnixNano(), q.counter),
+		GuildId:     q.GuildId,
+		Body:        json.RawMessage(body),
+		NextAttempt: now,
+		CreatedAt:   now,
+		Force:       force,
+	}
+	err = q.write(upload)
+	q.mutex.Unlock()
+	if err != nil {
+		return fmt.Errorf("failed to queue stash history upload: %w", err)
+	}
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// write atomically replaces the pending file of an upload
+func (q *UploadQueue) write(upload *queuedUpload) error {
+	data, err := json.Marshal(upload)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(q.pendingDir(), upload.Id+".json")
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func (q *UploadQueue) load() ([]*queuedUpload, error) {
+	files, err := filepath.Glob(filepath.Join(q.pendingDir(), "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+	uploads := make([]*queuedUpload, 0, len(files))
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		upload := &queuedUpload{}
+		if err := json.Unmarshal(data, upload); err != nil {
+			q.Notify("Warning: skipping corrupt upload queue file %s: %v", file, err)
+			continue
+		}
+		uploads = append(uploads, upload)
+	}
+	return uploads, nil
+}
+
+// Pending returns the number of pages that still need to be uploaded
+func (q *UploadQueue) Pending() int {
+	files, _ := filepath.Glob(filepath.Join(q.pendingDir(), "*.json"))
+	return len(files)
+}
+
+func (q *UploadQueue) backoff(attempts int) time.Duration {
+	delay := q.BaseBackoff
+	for i := 1; i < attempts && delay < q.MaxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > q.MaxBackoff {
+		delay = q.MaxBackoff
+	}
+	return delay
+}
+
+// processDue tries to upload every page whose backoff has expired, combined into batches.
+// It returns the time of the next scheduled attempt or the zero time if the queue is empty.
+// The queue is only locked while reading and rewriting its files, never during an upload. It
+// stops at the first credential error without counting it as a failed attempt.
+func (q *UploadQueue) processDue() (next time.Time, err error) {
+	q.sending.Lock()
+	defer q.sending.Unlock()
+
+	q.mutex.Lock()
+	uploads, err := q.load()
+	q.mutex.Unlock()
+	if err != nil {
+		return next, err
+	}
+	var due []*queuedUpload
+	for _, upload := range uploads {
+		if time.Now().Before(upload.NextAttempt) {
+			if next.IsZero() || upload.NextAttempt.Before(next) {
+				next = upload.NextAttempt
+			}
+			continue
+		}
+		due = append(due, upload)
+	}
+
+	for len(due) > 0 {
+		q.mutex.Lock()
+		batch, rest, body, ids, err := q.nextBatch(due)
+		q.mutex.Unlock()
+		if err != nil {
+			return next, err
+		}
+		due = rest
+		sendErr := q.sendBatch(body, ids)
+		var credErr *CredentialError
+		if errors.As(sendErr, &credErr) {
+			// Every other batch would fail the same way, retry once the credentials are fixed
+			return next, sendErr
+		}
+		if err := q.finishBatch(batch, sendErr, &next); err != nil {
+			return next, err
+		}
+	}
+	return next, nil
+}
+
+// finishBatch removes the pending files of a sent batch or, if sending failed, schedules the
+// next attempt of every upload in it and moves uploads that failed too often to the dead letters
+func (q *UploadQueue) finishBatch(batch []*queuedUpload, sendErr error, next *time.Time) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if sendErr == nil {
+		for _, upload := range batch {
+			if err := os.Remove(filepath.Join(q.pendingDir(), upload.Id+".json")); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	for _, upload := range batch {
+		upload.Attempts++
+		upload.LastError = sendErr.Error()
+		if upload.Attempts >= q.MaxAttempts {
+			q.Notify("Upload %s failed %d times, moving it to %s: %v", upload.Id, upload.Attempts, q.deadLetterPath(), sendErr)
+			if err := q.deadLetter(upload); err != nil {
+				return err
+			}
+			continue
+		}
+		upload.NextAttempt = time.Now().Add(q.backoff(upload.Attempts))
+		if err := q.write(upload); err != nil {
+			return err
+		}
+		if next.IsZero() || upload.NextAttempt.Before(*next) {
+			*next = upload.NextAttempt
+		}
+	}
+	return nil
+}
+
+// nextBatch takes uploads from the front of due until the batch holds at least BatchSize
+// entries and returns the uploads it didn't take. Entries that were uploaded in the meantime or
+// appear twice are left out. Uploads that can't be parsed will never succeed, so they are moved
+// to the dead letters instead of blocking the queue.
+func (q *UploadQueue) nextBatch(due []*queuedUpload) (batch, rest []*queuedUpload, body []byte, ids []string, err error) {
+	var entries []json.RawMessage
+	seen := make(map[string]struct{})
+	for len(due) > 0 {
+		if len(batch) > 0 && len(entries) >= q.BatchSize {
+			break
+		}
+		upload := due[0]
+		due = due[1:]
+		fresh, freshIds, err := q.freshEntries(upload.Body, seen, upload.Force)
+		if err != nil {
+			upload.LastError = fmt.Sprintf("failed to parse queued upload: %v", err)
+			q.Notify("Upload %s can't be parsed, moving it to %s: %v", upload.Id, q.deadLetterPath(), err)
+			if err := q.deadLetter(upload); err != nil {
+				return nil, nil, nil, nil, err
+			}
+			continue
+		}
+		batch = append(batch, upload)
+		entries = append(entries, fresh...)
+		ids = append(ids, freshIds...)
+	}
+	body, err = encodePage(entries)
+	return batch, due, body, ids, err
+}
+
+// sendBatch uploads a batch and records its ids. A backend that reports a different number
+// of added entries than we sent is only worth a warning: another admin may have sent them already.
+func (q *UploadQueue) sendBatch(body []byte, ids []string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	response, err := postStashHistory(q.BplJwt, q.GuildId, body)
+	if err != nil {
+		return err
+	}
+	if response.NumberOfAddedEntries != len(ids) {
+		q.Notify("Warning: BPL backend added %d of %d uploaded stash history entries for guild %d", response.NumberOfAddedEntries, len(ids), q.GuildId)
+	}
+	// The batch is accepted at this point, losing the ids only means they may be sent again
+	q.mutex.Lock()
+	err = q.markUploaded(ids)
+	q.mutex.Unlock()
+	if err != nil {
+		q.Notify("Warning: Could not record uploaded entry ids: %v", err)
+	}
+	return nil
+}
+
+func (q *UploadQueue) deadLetter(upload *queuedUpload) error {
+	data, err := json.Marshal(upload)
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(q.deadLetterPath(), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(append(data, '\n')); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Remove(filepath.Join(q.pendingDir(), upload.Id+".json"))
+}
+
+// Start uploads queued pages in the background until the returned stop function is called
+func (q *UploadQueue) Start() (stop func()) {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		for {
+			next, err := q.processDue()
+			if err != nil {
+				q.Notify("Error uploading stash history: %v", err)
+			}
+			wait := q.BaseBackoff
+			if !next.IsZero() {
+				wait = time.Until(next)
+			}
+			timer := time.NewTimer(wait)
+			select {
+			case <-done:
+				timer.Stop()
+				return
+			case <-q.wake:
+				timer.Stop()
+			case <-timer.C:
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
+
+// Drain keeps uploading until the queue is empty or the timeout expires. Pages that
+// are still pending afterwards stay on disk and are retried on the next run.
+func (q *UploadQueue) Drain(timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		next, err := q.processDue()
+		var credErr *CredentialError
+		if errors.As(err, &credErr) {
+			return err
+		}
+		if err != nil {
+			q.Notify("Error uploading stash history: %v", err)
+		}
+		if next.IsZero() && err == nil {
+			return nil
+		}
+		if next.IsZero() || next.After(deadline) {
+			break
+		}
+		time.Sleep(time.Until(next))
+	}
+	pending := q.Pending()
+	if pending == 0 {
+		return nil
+	}
+	return fmt.Errorf("%d stash history pages are still waiting to be uploaded, they will be retried on the next run", pending)
+}
+
+// Replay moves all dead-lettered pages back into the pending queue with a fresh retry budget
+func (q *UploadQueue) Replay() (int, error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	file, err := os.Open(q.deadLetterPath())
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	var uploads []*queuedUpload
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 1024*1024), 64*1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		upload := &queuedUpload{}
+		if err := json.Unmarshal([]byte(line), upload); err != nil {
+			file.Close()
+			return 0, fmt.Errorf("failed to parse dead-letter file: %w", err)
+		}
+		uploads = append(uploads, upload)
+	}
+	file.Close()
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+
+	for _, upload := range uploads {
+		upload.Attempts = 0
+		upload.NextAttempt = time.Now()
+		if err := q.write(upload); err != nil {
+			return 0, err
+		}
+	}
+	if err := os.Remove(q.deadLetterPath()); err != nil {
+		return 0, err
+	}
+	return len(uploads), nil
+}
+
+// ReplayFailedUploads re-queues the dead-lettered pages of every guild and uploads them
+func ReplayFailedUploads(bplJwt string) error {
+	dirs, err := os.ReadDir(uploadQueueDir)
+	if errors.Is(err, os.ErrNotExist) {
+		fmt.Println("No failed uploads found.")
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, dir := range dirs {
+		guildId, err := strconv.Atoi(dir.Name())
+		if !dir.IsDir() || err != nil {
+			continue
+		}
+		queue, err := NewUploadQueue(guildId, bplJwt)
+		if err != nil {
+			return err
+		}
+		replayed, err := queue.Replay()
+		if err != nil {
+			return fmt.Errorf("failed to replay uploads for guild %d: %w", guildId, err)
+		}
+		fmt.Printf("Guild %d: replaying %d failed and %d pending uploads\n", guildId, replayed, queue.Pending()-replayed)
+		if err := queue.Drain(5 * time.Minute); err != nil {
+			return fmt.Errorf("guild %d: %w", guildId, err)
+		}
+	}
+	fmt.Println("Replay completed.")
+	return nil
+}
@@ -0,0 +1,203 @@
+package guild_stash_logs
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// historyPage returns a stash history page with an entry for each id
+func historyPage(ids ...string) []byte {
+	entries := make([]string, len(ids))
+	for i, id := range ids {
+		entries[i] = fmt.Sprintf(`{"id":%q}`, id)
+	}
+	return []byte(`{"entries":[` + strings.Join(entries, ",") + `],"truncated":false}`)
+}
+
+// testUploadQueue returns a queue in a temporary directory that uploads to a backend answering
+// with the given status. The ids of every batch the backend received are appended to batches.
+func testUploadQueue(t *testing.T, status int, batches *[][]string) *UploadQueue {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reader, err := gzip.NewReader(r.Body)
+		if err != nil {
+			t.Errorf("reading upload: %v", err)
+			return
+		}
+		var page struct {
+			Entries []struct {
+				Id string `json:"id"`
+			} `json:"entries"`
+		}
+		if err := json.NewDecoder(reader).Decode(&page); err != nil {
+			t.Errorf("reading upload: %v", err)
+			return
+		}
+		var ids []string
+		for _, entry := range page.Entries {
+			ids = append(ids, entry.Id)
+		}
+		*batches = append(*batches, ids)
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(AddGuildStashHistoryResponse{NumberOfAddedEntries: len(ids)})
+	}))
+	t.Cleanup(server.Close)
+
+	baseUrl, queueDir := bplBaseUrl, uploadQueueDir
+	bplBaseUrl, uploadQueueDir = server.URL, t.TempDir()
+	t.Cleanup(func() { bplBaseUrl, uploadQueueDir = baseUrl, queueDir })
+
+	queue, err := NewUploadQueue(1, "jwt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	queue.Notify = func(string, ...any) {}
+	return queue
+}
+
+// deadLetters returns the number of uploads in the dead-letter file of the queue
+func deadLetters(t *testing.T, queue *UploadQueue) int {
+	t.Helper()
+	data, err := os.ReadFile(queue.deadLetterPath())
+	if errors.Is(err, os.ErrNotExist) {
+		return 0
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Count(string(data), "\n")
+}
+
+func TestUploadQueueProcessDue(t *testing.T) {
+	tests := []struct {
+		name        string
+		status      int
+		maxAttempts int
+		// uploaded are entries that were uploaded before
+		uploaded []string
+		pages    [][]byte
+		// wantBatches are the ids of every batch the backend receives
+		wantBatches  [][]string
+		wantPending  int
+		wantDead     int
+		wantAttempts int
+		wantCredErr  bool
+	}{
+		{"accepted", http.StatusCreated, 8, nil, [][]byte{historyPage("a", "b")}, [][]string{{"a", "b"}}, 0, 0, 0, false},
+		{"pages combined without duplicates", http.StatusCreated, 8, nil, [][]byte{historyPage("a", "b"), historyPage("b", "c")}, [][]string{{"a", "b", "c"}}, 0, 0, 0, false},
+		{"uploaded entries left out", http.StatusCreated, 8, []string{"a"}, [][]byte{historyPage("a", "b")}, [][]string{{"b"}}, 0, 0, 0, false},
+		{"only uploaded entries", http.StatusCreated, 8, []string{"a", "b"}, [][]byte{historyPage("a", "b")}, nil, 0, 0, 0, false},
+		{"backend error is retried", http.StatusInternalServerError, 8, nil, [][]byte{historyPage("a")}, [][]string{{"a"}}, 1, 0, 1, false},
+		{"failed too often", http.StatusInternalServerError, 1, nil, [][]byte{historyPage("a"), historyPage("b")}, [][]string{{"a", "b"}}, 0, 2, 0, false},
+		{"rejected token is not an attempt", http.StatusUnauthorized, 1, nil, [][]byte{historyPage("a")}, [][]string{{"a"}}, 1, 0, 0, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var batches [][]string
+			queue := testUploadQueue(t, test.status, &batches)
+			queue.MaxAttempts = test.maxAttempts
+			if err := queue.markUploaded(test.uploaded); err != nil {
+				t.Fatal(err)
+			}
+			for _, page := range test.pages {
+				if err := queue.Enqueue(page); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			next, err := queue.processDue()
+			var credErr *CredentialError
+			if errors.As(err, &credErr) != test.wantCredErr {
+				t.Fatalf("processDue() error = %v, want credential error %v", err, test.wantCredErr)
+			}
+			if !test.wantCredErr && err != nil {
+				t.Fatalf("processDue() error = %v", err)
+			}
+			if !slices.EqualFunc(batches, test.wantBatches, slices.Equal) {
+				t.Errorf("backend received %v, want %v", batches, test.wantBatches)
+			}
+			if got := queue.Pending(); got != test.wantPending {
+				t.Errorf("%d uploads pending, want %d", got, test.wantPending)
+			}
+			if got := deadLetters(t, queue); got != test.wantDead {
+				t.Errorf("%d dead letters, want %d", got, test.wantDead)
+			}
+			uploads, err := queue.load()
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, upload := range uploads {
+				if upload.Attempts != test.wantAttempts {
+					t.Errorf("upload %s has %d attempts, want %d", upload.Id, upload.Attempts, test.wantAttempts)
+				}
+			}
+			if retried := test.wantAttempts > 0; retried != !next.IsZero() {
+				t.Errorf("next attempt at %v, want one scheduled %v", next, retried)
+			}
+		})
+	}
+}
+
+func TestUploadQueueBackoff(t *testing.T) {
+	queue := &UploadQueue{BaseBackoff: 5 * time.Second, MaxBackoff: time.Minute}
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{1, 5 * time.Second},
+		{2, 10 * time.Second},
+		{4, 40 * time.Second},
+		{5, time.Minute},
+		{20, time.Minute},
+	}
+
+	for _, test := range tests {
+		t.Run(fmt.Sprint(test.attempts), func(t *testing.T) {
+			if got := queue.backoff(test.attempts); got != test.want {
+				t.Errorf("backoff(%d) = %v, want %v", test.attempts, got, test.want)
+			}
+		})
+	}
+}
+
+func TestUploadQueueReplay(t *testing.T) {
+	var batches [][]string
+	queue := testUploadQueue(t, http.StatusInternalServerError, &batches)
+	queue.MaxAttempts = 1
+	if err := queue.Enqueue(historyPage("a")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := queue.processDue(); err != nil {
+		t.Fatal(err)
+	}
+	if got := deadLetters(t, queue); got != 1 {
+		t.Fatalf("%d dead letters, want 1", got)
+	}
+
+	replayed, err := queue.Replay()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if replayed != 1 || queue.Pending() != 1 || deadLetters(t, queue) != 0 {
+		t.Errorf("replayed %d, %d pending, %d dead letters, want 1, 1, 0", replayed, queue.Pending(), deadLetters(t, queue))
+	}
+	uploads, err := queue.load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, upload := range uploads {
+		if upload.Attempts != 0 || time.Now().Before(upload.NextAttempt) {
+			t.Errorf("replayed upload has %d attempts, next at %v, want a fresh budget", upload.Attempts, upload.NextAttempt)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package guild_stash_logs
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// PriceTable holds the chaos value of one item by name. It is read from a JSON object that maps
+// item names to chaos values, e.g. {"Divine Orb": 180, "Headhunter": 4500}. Names are matched
+// case-insensitively against the unique name, the item without its stack size and, for
+// currency, gems, divination cards and normal items, the base type.
+type PriceTable struct {
+	prices map[string]float64
+}
+
+// LoadPriceTable reads a price table from a JSON file
+func LoadPriceTable(path string) (*PriceTable, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var prices map[string]float64
+	if err := json.Unmarshal(data, &prices); err != nil {
+		return nil, fmt.Errorf("failed to parse price file %s: %w", path, err)
+	}
+	return NewPriceTable(prices), nil
+}
+
+// NewPriceTable creates a price table from chaos values by item name. A Chaos Orb is worth 1
+// unless prices says otherwise.
+func NewPriceTable(prices map[string]float64) *PriceTable {
+	table := &PriceTable{prices: map[string]float64{"chaos orb": 1}}
+	for name, value := range prices {
+		table.prices[strings.ToLower(strings.TrimSpace(name))] = value
+	}
+	return table
+}
+
+// Price returns the chaos value of a single item
+func (t *PriceTable) Price(item string, parsed ParsedItem) (float64, bool) {
+	names := []string{parsed.Name, stackName(strings.TrimSpace(item))}
+	switch parsed.Rarity {
+	case RarityCurrency, RarityGem, RarityDivination, RarityNormal:
+		names = append(names, parsed.BaseType)
+	}
+	for _, name := range names {
+		if name == "" {
+			continue
+		}
+		if value, ok := t.prices[strings.ToLower(name)]; ok {
+			return value, true
+		}
+	}
+	return 0, false
+}
+
+// Value returns the chaos value of everything an entry moved, i.e. the price times the stack size
+func (t *PriceTable) Value(entry GuildStashEntry) (float64, bool) {
+	price, ok := t.Price(entry.Item, entry.Parsed)
+	return price * float64(max(entry.Parsed.StackSize, 1)), ok
+}
@@ -0,0 +1,50 @@
+package guild_stash_logs
+
+import "testing"
+
+func TestPriceTable(t *testing.T) {
+	prices := NewPriceTable(map[string]float64{
+		"Divine Orb":     180,
+		" headhunter ":   4500,
+		"Heavy Belt":     2,
+		"Stygian Vise":   3,
+		"The Apothecary": 900,
+	})
+	tests := []struct {
+		name string
+		item string
+		// parsed overrides the parsed item if set
+		parsed    *ParsedItem
+		wantPrice float64
+		wantValue float64
+		wantOk    bool
+	}{
+		{"single currency", "Divine Orb", nil, 180, 180, true},
+		{"currency stack", "3x Divine Orb", nil, 180, 540, true},
+		{"chaos orb default", "20x Chaos Orb", nil, 1, 20, true},
+		{"divination card stack", "7x The Apothecary", nil, 900, 6300, true},
+		{"unique by name", "Headhunter Leather Belt", nil, 4500, 4500, true},
+		{"unique without base type fallback", "Mageblood Heavy Belt", nil, 0, 0, false},
+		{"normal item", "Stygian Vise", nil, 3, 3, true},
+		{"magic item without base type fallback", "Superior Stygian Vise", nil, 0, 0, false},
+		{"currency by base type", "Divine Orb (Legacy)", &ParsedItem{StackSize: 2, BaseType: "Divine Orb", Rarity: RarityCurrency}, 180, 360, true},
+		{"unpriced item", "5x Orb of Alteration", nil, 0, 0, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			entry := stashEntry("1", 1, "added", "a", test.item, 0, 0)
+			if test.parsed != nil {
+				entry.Parsed = *test.parsed
+			}
+			price, ok := prices.Price(entry.Item, entry.Parsed)
+			if price != test.wantPrice || ok != test.wantOk {
+				t.Errorf("Price(%q) = %v, %v, want %v, %v", test.item, price, ok, test.wantPrice, test.wantOk)
+			}
+			value, ok := prices.Value(entry)
+			if value != test.wantValue || ok != test.wantOk {
+				t.Errorf("Value(%q) = %v, %v, want %v, %v", test.item, value, ok, test.wantValue, test.wantOk)
+			}
+		})
+	}
+}
@@ -7,8 +7,11 @@ import (
 	"io"
 	"net/http"
 	"regexp"
+	"strconv"
 	"strings"
 	"time"
+
+	"tools/rate_limiter"
 )
 
 // CredentialError represents an error related to invalid credentials
@@ -57,6 +60,7 @@ type AcceptRequest struct {
 
 type Client struct {
 	Client          *http.Client
+	RateLimiter     *rate_limiter.RateLimiter
 	PoeSessID       string
 	BPLToken        string
 	PrivateLeagueId string
@@ -69,10 +73,11 @@ type Event struct {
 
 func NewClient(poeSessID, bplToken string) (*Client, error) {
 	client := &Client{
-		Client:    &http.Client{},
-		PoeSessID: poeSessID,
-		BPLToken:  bplToken,
-		BPLUrl:    "https://v2202503259898322516.goodsrv.de/api",
+		Client:      &http.Client{},
+		RateLimiter: rate_limiter.ForAccount(poeSessID),
+		PoeSessID:   poeSessID,
+		BPLToken:    bplToken,
+		BPLUrl:      "https://v2202503259898322516.goodsrv.de/api",
 	}
 	err := client.setPrivateLeagueId()
 	if err != nil {
@@ -106,6 +111,36 @@ func (c *Client) setPrivateLeagueId() error {
 	return nil
 }
 
+// privateLeagueEndpoint names the private league API for the rate limiter
+const privateLeagueEndpoint = "private-league-member"
+
+// doPoeRequest sends a request to the PoE API through the account's shared rate limiter
+func (c *Client) doPoeRequest(req *http.Request) (*http.Response, error) {
+	if _, err := c.RateLimiter.Wait(req.Context(), privateLeagueEndpoint); err != nil {
+		return nil, err
+	}
+	resp, err := c.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusTooManyRequests {
+		resp.Body.Close()
+		retry, err := strconv.Atoi(resp.Header.Get("retry-after"))
+		if err != nil {
+			retry = 60
+		}
+		duration := time.Duration(retry) * time.Second
+		c.RateLimiter.Penalize(duration)
+		return nil, fmt.Errorf("HttpStatusCode: %d (Too many requests - Wait %v before trying again)", resp.StatusCode, duration)
+	}
+	if resp.StatusCode == http.StatusOK {
+		if updateErr := c.RateLimiter.UpdateFromResponse(privateLeagueEndpoint, resp); updateErr != nil {
+			fmt.Printf("Warning: Could not update rate limiter: %v\n", updateErr)
+		}
+	}
+	return resp, nil
+}
+
 func (c *Client) getLeagueJoinRequests() ([]Member, []Member, error) {
 	req, err := http.NewRequest("GET", fmt.Sprintf("https://www.pathofexile.com/api/private-league-member/%s", c.PrivateLeagueId), nil)
 	if err != nil {
@@ -124,7 +159,7 @@ func (c *Client) getLeagueJoinRequests() ([]Member, []Member, error) {
 	q.Add("_", fmt.Sprintf("%d", time.Now().Unix()))
 	req.URL.RawQuery = q.Encode()
 
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := c.doPoeRequest(req)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -162,12 +197,29 @@ func (c *Client) getLeagueJoinRequests() ([]Member, []Member, error) {
 }
 
 func (c *Client) getSortedUsers() (map[string]bool, error) {
-	req, err := http.NewRequest("GET", c.BPLUrl+"/events/current/signups", nil)
+	players, err := FetchSignups(c.BPLUrl, c.BPLToken)
 	if err != nil {
 		return nil, err
 	}
 
-	req.Header.Set("Authorization", "Bearer "+c.BPLToken)
+	sortedUsers := make(map[string]bool)
+	for _, player := range players {
+		if player.TeamID != nil {
+			sortedUsers[player.User.AccountName] = true
+		}
+	}
+
+	return sortedUsers, nil
+}
+
+// FetchSignups returns everyone who signed up for the current event, including the team they were sorted into
+func FetchSignups(bplUrl, bplToken string) ([]Player, error) {
+	req, err := http.NewRequest("GET", bplUrl+"/events/current/signups", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Authorization", "Bearer "+bplToken)
 
 	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
@@ -192,15 +244,7 @@ func (c *Client) getSortedUsers() (map[string]bool, error) {
 	if err != nil {
 		return nil, err
 	}
-
-	sortedUsers := make(map[string]bool)
-	for _, player := range players {
-		if player.TeamID != nil {
-			sortedUsers[player.User.AccountName] = true
-		}
-	}
-
-	return sortedUsers, nil
+	return players, nil
 }
 
 func (c *Client) acceptPrivateLeagueInvites(members []Member) error {
@@ -228,7 +272,7 @@ func (c *Client) acceptPrivateLeagueInvites(members []Member) error {
 	req.Header.Set("X-Requested-With", "XMLHttpRequest")
 	req.AddCookie(&http.Cookie{Name: "POESESSID", Value: c.PoeSessID})
 
-	resp, err := c.Client.Do(req)
+	resp, err := c.doPoeRequest(req)
 	if err != nil {
 		return err
 	}
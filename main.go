@@ -6,12 +6,14 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 
 	"tools/check_player_characters"
 	"tools/guild_stash_logs"
 	"tools/league_invites"
+	"tools/rate_limiter"
 
 	"github.com/AlecAivazis/survey/v2"
 )
@@ -28,6 +30,13 @@ func init() {
 	loadEnvFromFile("bpl-config.txt")
 	bplToken = os.Getenv("BPL_TOKEN")
 	poeSessID = os.Getenv("POESESSID")
+	if value := os.Getenv("RATE_LIMIT_SAFETY_MARGIN"); value != "" {
+		if percent, err := strconv.Atoi(value); err == nil && percent >= 0 && percent < 100 {
+			rate_limiter.DefaultSafetyMargin = float64(percent) / 100
+		} else {
+			log.Printf("Warning: Ignoring invalid RATE_LIMIT_SAFETY_MARGIN %q, expected a percentage between 0 and 99", value)
+		}
+	}
 }
 
 // loadEnvFromFile loads environment variables from a file
@@ -435,6 +444,106 @@ func runPrivateLeagueInvitesContinuous() error {
 	})
 }
 
+// guildStashOptions builds the stash monitor options from the optional settings in bpl-config.txt
+func guildStashOptions() (guild_stash_logs.Options, error) {
+	options := guild_stash_logs.DefaultOptions()
+	if value := os.Getenv("GUILD_ID"); value != "" {
+		// Unlike the other settings an invalid GUILD_ID is an error, ignoring it would disable the guild check
+		guildId, err := strconv.Atoi(value)
+		if err != nil || guildId <= 0 {
+			return options, fmt.Errorf("invalid GUILD_ID %q, expected the number from your guild's profile URL", value)
+		}
+		options.GuildId = guildId
+	}
+	if value := os.Getenv("MAX_RATE_LIMIT_WAIT"); value != "" {
+		if duration, err := time.ParseDuration(value); err == nil {
+			options.MaxRateLimitWait = duration
+		} else {
+			log.Printf("Warning: Ignoring invalid MAX_RATE_LIMIT_WAIT %q: %v", value, err)
+		}
+	}
+	if value := os.Getenv("POLL_MIN_INTERVAL"); value != "" {
+		if duration, err := time.ParseDuration(value); err == nil {
+			options.Polling.MinInterval = duration
+		} else {
+			log.Printf("Warning: Ignoring invalid POLL_MIN_INTERVAL %q: %v", value, err)
+		}
+	}
+	if value := os.Getenv("POLL_MAX_INTERVAL"); value != "" {
+		if duration, err := time.ParseDuration(value); err == nil {
+			options.Polling.MaxInterval = duration
+		} else {
+			log.Printf("Warning: Ignoring invalid POLL_MAX_INTERVAL %q: %v", value, err)
+		}
+	}
+	if value := os.Getenv("BACKFILL_WORKERS"); value != "" {
+		if workers, err := strconv.Atoi(value); err == nil && workers > 0 {
+			options.Backfill.Workers = workers
+		} else {
+			log.Printf("Warning: Ignoring invalid BACKFILL_WORKERS %q, expected a positive number", value)
+		}
+	}
+	if value, ok := os.LookupEnv("PRICE_FILE"); ok {
+		options.PriceFile = value
+	}
+	if value := os.Getenv("PROGRESS_OUTPUT"); value != "" {
+		if _, err := guild_stash_logs.NewProgressReporter(value); err == nil {
+			options.Progress = value
+		} else {
+			log.Printf("Warning: Ignoring invalid PROGRESS_OUTPUT: %v", err)
+		}
+	}
+	if value := os.Getenv("ALERT_WITHDRAWAL_LIMIT"); value != "" {
+		if limit, err := strconv.Atoi(value); err == nil {
+			options.Alerts.WithdrawalLimit = limit
+		} else {
+			log.Printf("Warning: Ignoring invalid ALERT_WITHDRAWAL_LIMIT %q: %v", value, err)
+		}
+	}
+	if value := os.Getenv("ALERT_WITHDRAWAL_WINDOW"); value != "" {
+		if duration, err := time.ParseDuration(value); err == nil {
+			options.Alerts.WithdrawalWindow = duration
+		} else {
+			log.Printf("Warning: Ignoring invalid ALERT_WITHDRAWAL_WINDOW %q: %v", value, err)
+		}
+	}
+	options.Alerts.ProtectedTabs = splitList(os.Getenv("ALERT_PROTECTED_TABS"))
+	options.Alerts.TeamAccounts = splitList(os.Getenv("ALERT_TEAM_ACCOUNTS"))
+	// ALERT_TEAM_ACCOUNTS_<GUILD_ID> overrides the list for one guild
+	for _, variable := range os.Environ() {
+		name, value, _ := strings.Cut(variable, "=")
+		suffix, ok := strings.CutPrefix(name, "ALERT_TEAM_ACCOUNTS_")
+		if !ok {
+			continue
+		}
+		guildId, err := strconv.Atoi(suffix)
+		if err != nil {
+			log.Printf("Warning: Ignoring %s, expected ALERT_TEAM_ACCOUNTS_<GUILD_ID>", name)
+			continue
+		}
+		if options.Alerts.GuildTeamAccounts == nil {
+			options.Alerts.GuildTeamAccounts = make(map[int][]string)
+		}
+		options.Alerts.GuildTeamAccounts[guildId] = splitList(value)
+	}
+	if value, ok := os.LookupEnv("ALERT_LOG_FILE"); ok {
+		options.Alerts.LogFile = value
+	}
+	options.Alerts.WebhookUrl = os.Getenv("ALERT_WEBHOOK_URL")
+	return options, nil
+}
+
+// splitList splits a comma separated setting into its trimmed, non-empty values
+func splitList(value string) []string {
+	var values []string
+	for _, part := range strings.Split(value, ",") {
+		if part = strings.TrimSpace(part); part != "" {
+			values = append(values, part)
+		}
+	}
+	return values
+}
+
 func runGuildStashSingle() error {
 	envVars := []EnvVar{
 		{Name: "POESESSID", Description: "Path of Exile session ID from browser", Required: true},
@@ -445,9 +554,14 @@ func runGuildStashSingle() error {
 		return err
 	}
 
+	options, err := guildStashOptions()
+	if err != nil {
+		return err
+	}
+
 	fmt.Println("Running guild stash monitoring...")
 	return runWithCredentialRetry(func() error {
-		return guild_stash_logs.RunStashMonitoring(poeSessID, bplToken)
+		return guild_stash_logs.RunStashMonitoring(poeSessID, bplToken, options)
 	})
 }
 
@@ -461,10 +575,270 @@ func runGuildStashContinuous() error {
 		return err
 	}
 
-	fmt.Println("Starting continuous guild stash monitoring (every 5 minutes)...")
+	options, err := guildStashOptions()
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Starting continuous guild stash monitoring (every %v to %v, depending on activity)...\n", options.Polling.MinInterval, options.Polling.MaxInterval)
+	fmt.Println("Press Ctrl+C to stop")
+	return runWithCredentialRetry(func() error {
+		return guild_stash_logs.RunStashMonitoringContinuous(poeSessID, bplToken, 5*time.Minute, options)
+	})
+}
+
+func runGuildStashMultiGuild() error {
+	envVars := []EnvVar{
+		{Name: "GUILD_SESSIONS", Description: "comma separated POESESSID:GUILD_ID pairs, one per guild", Required: true},
+		{Name: "BPL_TOKEN", Description: "BPL API token for authentication", Required: true},
+	}
+
+	if err := ensureEnvVars(envVars); err != nil {
+		return err
+	}
+
+	sessions, err := guild_stash_logs.ParseGuildSessions(os.Getenv("GUILD_SESSIONS"))
+	if err != nil {
+		return fmt.Errorf("invalid GUILD_SESSIONS: %w", err)
+	}
+	options, err := guildStashOptions()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Starting continuous guild stash monitoring for %d guilds (every %v to %v, depending on activity)...\n", len(sessions), options.Polling.MinInterval, options.Polling.MaxInterval)
 	fmt.Println("Press Ctrl+C to stop")
+	return guild_stash_logs.RunMultiGuildMonitoring(sessions, bplToken, 5*time.Minute, options)
+}
+
+// reportWindows are the time windows offered for stash reports. A zero duration means the whole league.
+var reportWindows = []struct {
+	Name     string
+	Duration time.Duration
+}{
+	{"Last 24 hours", 24 * time.Hour},
+	{"Last 3 days", 3 * 24 * time.Hour},
+	{"Last 7 days", 7 * 24 * time.Hour},
+	{"Whole league", 0},
+}
+
+// askReportWindow asks for the time window of a report and returns its start and end
+func askReportWindow() (start, end time.Time, err error) {
+	names := make([]string, len(reportWindows))
+	for i, window := range reportWindows {
+		names[i] = window.Name
+	}
+	var selected string
+	if err := survey.AskOne(&survey.Select{Message: "Time window:", Options: names}, &selected); err != nil {
+		return start, end, err
+	}
+	end = time.Now()
+	for _, window := range reportWindows {
+		if window.Name == selected && window.Duration > 0 {
+			start = end.Add(-window.Duration)
+		}
+	}
+	return start, end, nil
+}
+
+// askReportOutput asks for the report format and opens the matching output. Tables are
+// printed, CSV and JSON reports are written to a file.
+func askReportOutput(name string) (format string, out *os.File, err error) {
+	prompt := &survey.Select{Message: "Output format:", Options: []string{"table", "csv", "json"}}
+	if err := survey.AskOne(prompt, &format); err != nil {
+		return "", nil, err
+	}
+	if format == "table" {
+		return format, os.Stdout, nil
+	}
+	filename := fmt.Sprintf("%s-%s.%s", name, time.Now().Format("20060102-150405"), format)
+	out, err = os.Create(filename)
+	if err != nil {
+		return "", nil, err
+	}
+	fmt.Printf("Writing report to %s\n", filename)
+	return format, out, nil
+}
+
+func runGuildStashReport() error {
+	envVars := []EnvVar{
+		{Name: "POESESSID", Description: "Path of Exile session ID from browser", Required: true},
+		{Name: "BPL_TOKEN", Description: "BPL API token for authentication", Required: true},
+	}
+
+	if err := ensureEnvVars(envVars); err != nil {
+		return err
+	}
+
+	start, end, err := askReportWindow()
+	if err != nil {
+		return err
+	}
+	format, out, err := askReportOutput("stash-contributions")
+	if err != nil {
+		return err
+	}
+	if out != os.Stdout {
+		defer out.Close()
+	}
+
+	options, err := guildStashOptions()
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("Fetching guild stash history for the report...")
+	return runWithCredentialRetry(func() error {
+		return guild_stash_logs.RunContributionReport(poeSessID, bplToken, options, start, end, format, out)
+	})
+}
+
+func runGuildStashDryRun() error {
+	envVars := []EnvVar{
+		{Name: "POESESSID", Description: "Path of Exile session ID from browser", Required: true},
+		{Name: "BPL_TOKEN", Description: "BPL API token for authentication", Required: true},
+	}
+
+	if err := ensureEnvVars(envVars); err != nil {
+		return err
+	}
+
+	options, err := guildStashOptions()
+	if err != nil {
+		return err
+	}
+	prompt := &survey.Select{Message: "Export format:", Options: []string{"jsonl", "csv"}}
+	if err := survey.AskOne(prompt, &options.ExportFormat); err != nil {
+		return err
+	}
+	options.DryRun = true
+
+	fmt.Println("Running guild stash monitoring as a dry run...")
 	return runWithCredentialRetry(func() error {
-		return guild_stash_logs.RunStashMonitoringContinuous(poeSessID, bplToken, 5*time.Minute)
+		return guild_stash_logs.RunStashMonitoring(poeSessID, bplToken, options)
+	})
+}
+
+func runGuildStashVerify() error {
+	envVars := []EnvVar{
+		{Name: "POESESSID", Description: "Path of Exile session ID from browser", Required: true},
+		{Name: "BPL_TOKEN", Description: "BPL API token for authentication", Required: true},
+	}
+
+	if err := ensureEnvVars(envVars); err != nil {
+		return err
+	}
+
+	options, err := guildStashOptions()
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("Verifying guild stash history coverage...")
+	return runWithCredentialRetry(func() error {
+		return guild_stash_logs.RunCoverageVerification(poeSessID, bplToken, options)
+	})
+}
+
+// askBackfillWindow asks for the start and end of a backfill until both parse
+func askBackfillWindow() (start, end time.Time, err error) {
+	var startValue, endValue string
+	startPrompt := &survey.Input{
+		Message: "Start (e.g. \"last 6h\", \"2d ago\" or \"2025-06-01 12:00\"):",
+		Default: "last 6h",
+	}
+	err = survey.AskOne(startPrompt, &startValue, survey.WithValidator(func(value any) error {
+		_, _, err := guild_stash_logs.ParseTimeWindow(value.(string), "now", time.Now())
+		return err
+	}))
+	if err != nil {
+		return start, end, err
+	}
+	validate := func(value any) error {
+		_, err := guild_stash_logs.ParseTime(value.(string), time.Now())
+		return err
+	}
+	err = survey.AskOne(&survey.Input{Message: "End:", Default: "now"}, &endValue, survey.WithValidator(validate))
+	if err != nil {
+		return start, end, err
+	}
+	return guild_stash_logs.ParseTimeWindow(startValue, endValue, time.Now())
+}
+
+func runGuildStashBackfill() error {
+	envVars := []EnvVar{
+		{Name: "POESESSID", Description: "Path of Exile session ID from browser", Required: true},
+		{Name: "BPL_TOKEN", Description: "BPL API token for authentication", Required: true},
+	}
+
+	if err := ensureEnvVars(envVars); err != nil {
+		return err
+	}
+
+	options, err := guildStashOptions()
+	if err != nil {
+		return err
+	}
+	start, end, err := askBackfillWindow()
+	if err != nil {
+		return err
+	}
+	forcePrompt := &survey.Confirm{
+		Message: "Upload entries again even if they were uploaded before?",
+		Default: false,
+	}
+	if err := survey.AskOne(forcePrompt, &options.ForceResend); err != nil {
+		return err
+	}
+
+	fmt.Printf("Backfilling guild stash history from %s to %s...\n", start.Format("2006-01-02 15:04"), end.Format("2006-01-02 15:04"))
+	return runWithCredentialRetry(func() error {
+		return guild_stash_logs.RunBackfill(poeSessID, bplToken, options, start, end)
+	})
+}
+
+func runGuildStashTabContents() error {
+	options, err := guildStashOptions()
+	if err != nil {
+		return err
+	}
+	var atValue, stash string
+	atPrompt := &survey.Input{Message: "Time (e.g. \"now\", \"6h ago\" or \"2025-06-01 12:00\"):", Default: "now"}
+	err = survey.AskOne(atPrompt, &atValue, survey.WithValidator(func(value any) error {
+		_, err := guild_stash_logs.ParseTime(value.(string), time.Now())
+		return err
+	}))
+	if err != nil {
+		return err
+	}
+	at, err := guild_stash_logs.ParseTime(atValue, time.Now())
+	if err != nil {
+		return err
+	}
+	if err := survey.AskOne(&survey.Input{Message: "Tab name (empty for all tabs):"}, &stash); err != nil {
+		return err
+	}
+	format, out, err := askReportOutput("stash-tab-contents")
+	if err != nil {
+		return err
+	}
+	if out != os.Stdout {
+		defer out.Close()
+	}
+	return guild_stash_logs.RunStashReplay(options, at, strings.TrimSpace(stash), format, out)
+}
+
+func runGuildStashReplay() error {
+	envVars := []EnvVar{
+		{Name: "BPL_TOKEN", Description: "BPL API token for authentication", Required: true},
+	}
+
+	if err := ensureEnvVars(envVars); err != nil {
+		return err
+	}
+
+	fmt.Println("Replaying failed stash history uploads...")
+	return runWithCredentialRetry(func() error {
+		return guild_stash_logs.ReplayFailedUploads(bplToken)
 	})
 }
 
@@ -489,6 +863,11 @@ func showRunModeMenu(toolName string, singleAction, continuousAction func() erro
 		},
 	}
 
+	return selectMenuOption(fmt.Sprintf("%s - Select run mode:", toolName), options)
+}
+
+// selectMenuOption shows a select prompt for the given options and runs the chosen action
+func selectMenuOption(message string, options []MenuOption) error {
 	optionNames := make([]string, len(options))
 	for i, option := range options {
 		optionNames[i] = option.Name
@@ -496,7 +875,7 @@ func showRunModeMenu(toolName string, singleAction, continuousAction func() erro
 
 	var selected string
 	prompt := &survey.Select{
-		Message: fmt.Sprintf("%s - Select run mode:", toolName),
+		Message: message,
 		Options: optionNames,
 		Description: func(value string, index int) string {
 			if index < len(options) {
@@ -530,42 +909,65 @@ func showPrivateLeagueInvitesMenu() error {
 }
 
 func showGuildStashMenu() error {
-	return showRunModeMenu("Guild Stash Monitor", runGuildStashSingle, runGuildStashContinuous)
-}
-
-func showMainMenu() error {
-	options := getMainMenuOptions()
-	optionNames := make([]string, len(options))
-
-	for i, option := range options {
-		optionNames[i] = option.Name
-	}
-
-	var selected string
-	prompt := &survey.Select{
-		Message: "BPL Tools - Select an option:",
-		Options: optionNames,
-		Description: func(value string, index int) string {
-			if index < len(options) {
-				return options[index].Description
-			}
-			return ""
+	options := []MenuOption{
+		{
+			Name:        "Run Once",
+			Description: "Run Guild Stash Monitor once",
+			Action:      runGuildStashSingle,
+		},
+		{
+			Name:        "Run Continuously",
+			Description: "Run Guild Stash Monitor continuously, polling more often when the stash is busy",
+			Action:      runGuildStashContinuous,
+		},
+		{
+			Name:        "Run Multiple Guilds Continuously",
+			Description: "Monitor every guild listed in GUILD_SESSIONS from this process",
+			Action:      runGuildStashMultiGuild,
+		},
+		{
+			Name:        "Dry Run (Export Only)",
+			Description: "Fetch the whole stash history into a JSONL or CSV file without sending anything to the BPL backend",
+			Action:      runGuildStashDryRun,
+		},
+		{
+			Name:        "Contribution Report",
+			Description: "Summarise what each account added to and removed from the guild stash",
+			Action:      runGuildStashReport,
+		},
+		{
+			Name:        "Stash Tab Contents",
+			Description: "Rebuild what a tab held at a given time from the local stash history",
+			Action:      runGuildStashTabContents,
+		},
+		{
+			Name:        "Verify Coverage",
+			Description: "Find gaps in the stash history and re-fetch only those windows",
+			Action:      runGuildStashVerify,
+		},
+		{
+			Name:        "Backfill Time Window",
+			Description: "Re-fetch the stash history of a chosen time window and upload what is missing",
+			Action:      runGuildStashBackfill,
+		},
+		{
+			Name:        "Replay Failed Uploads",
+			Description: "Retry stash history pages that could not be uploaded to the BPL backend",
+			Action:      runGuildStashReplay,
+		},
+		{
+			Name:        "Back to Main Menu",
+			Description: "Return to the main menu",
+			Action: func() error {
+				return nil
+			},
 		},
 	}
+	return selectMenuOption("Guild Stash Monitor - Select an option:", options)
+}
 
-	err := survey.AskOne(prompt, &selected)
-	if err != nil {
-		return err
-	}
-
-	// Find the selected option and execute its action
-	for _, option := range options {
-		if option.Name == selected {
-			return option.Action()
-		}
-	}
-
-	return fmt.Errorf("unknown option selected")
+func showMainMenu() error {
+	return selectMenuOption("BPL Tools - Select an option:", getMainMenuOptions())
 }
 
 func main() {
@@ -0,0 +1,539 @@
+package rate_limiter
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Policy struct {
+	MaxHits int
+	Period  time.Duration
+	// Penalty is how long PoE restricts us if this policy is violated
+	Penalty time.Duration
+}
+
+func (p *Policy) CurrentHits(requestTimes []time.Time) int {
+	periodStart := time.Now().Add(-p.Period)
+	count := 0
+	for _, t := range requestTimes {
+		if t.After(periodStart) {
+			count++
+		}
+	}
+	return count
+}
+
+// EffectiveMaxHits is the number of hits we allow ourselves when staying the given
+// fraction below the limit. It never drops below one hit per period.
+func (p *Policy) EffectiveMaxHits(safetyMargin float64) int {
+	reserved := int(math.Ceil(float64(p.MaxHits) * safetyMargin))
+	return max(p.MaxHits-reserved, 1)
+}
+
+func (p *Policy) IsViolated(requestTimes []time.Time, safetyMargin float64) bool {
+	return p.CurrentHits(requestTimes) >= p.EffectiveMaxHits(safetyMargin)
+}
+
+// NextFree returns when the policy allows the next hit. Hits booked in the future
+// count as well, so the result is never earlier than what those bookings allow.
+func (p *Policy) NextFree(requestTimes []time.Time, safetyMargin float64, now time.Time) time.Time {
+	periodStart := now.Add(-p.Period)
+	inWindow := make([]time.Time, 0, len(requestTimes))
+	for _, t := range requestTimes {
+		if t.After(periodStart) {
+			inWindow = append(inWindow, t)
+		}
+	}
+	limit := p.EffectiveMaxHits(safetyMargin)
+	if len(inWindow) < limit {
+		return now
+	}
+	slices.SortFunc(inWindow, func(a, b time.Time) int {
+		return a.Compare(b)
+	})
+	return inWindow[len(inWindow)-limit].Add(p.Period)
+}
+
+// rule tracks a single PoE rate limit rule (Account, Ip, Client) independently
+type rule struct {
+	name     string
+	policies []Policy
+	// sources are the policies every X-Rate-Limit-Policy reported for this rule. policies is
+	// their union, so endpoints that share a rule don't overwrite each other's limits.
+	sources         map[string][]Policy
+	requestTimes    []time.Time
+	restrictedUntil time.Time
+}
+
+// setPolicies replaces the policies the given X-Rate-Limit-Policy reported for the rule
+func (r *rule) setPolicies(source string, policies []Policy) {
+	if r.sources == nil {
+		r.sources = make(map[string][]Policy)
+	}
+	r.sources[source] = policies
+	r.policies = nil
+	for _, key := range slices.Sorted(maps.Keys(r.sources)) {
+		r.policies = append(r.policies, r.sources[key]...)
+	}
+}
+
+// ruleKey returns the key a rule is tracked under. The Account rule counts every request of
+// the account, so all endpoints share it. Ip and Client rules belong to the policy of the
+// endpoint, e.g. the stash history or the private league policy.
+func ruleKey(policy, name string) string {
+	name = strings.ToLower(name)
+	if name == "account" || policy == "" {
+		return name
+	}
+	return strings.ToLower(policy) + ":" + name
+}
+
+// nextFree returns the earliest time at which a request satisfies every policy of the rule
+func (r *rule) nextFree(now time.Time, safetyMargin float64) time.Time {
+	next := now
+	if r.restrictedUntil.After(next) {
+		next = r.restrictedUntil
+	}
+	for _, policy := range r.policies {
+		if free := policy.NextFree(r.requestTimes, safetyMargin, now); free.After(next) {
+			next = free
+		}
+	}
+	return next
+}
+
+// cleanExpiredRequests removes requests that are older than the longest policy period
+func (r *rule) cleanExpiredRequests(now time.Time) {
+	longest := time.Duration(0)
+	for _, policy := range r.policies {
+		longest = max(longest, policy.Period)
+	}
+	cutoff := now.Add(-longest)
+
+	validRequests := make([]time.Time, 0, len(r.requestTimes))
+	for _, reqTime := range r.requestTimes {
+		if reqTime.After(cutoff) {
+			validRequests = append(validRequests, reqTime)
+		}
+	}
+
+	r.requestTimes = validRequests
+}
+
+// DefaultSafetyMargin is the fraction of every limit new rate limiters keep in reserve
+var DefaultSafetyMargin = 0.1
+
+type RateLimiter struct {
+	mutex sync.Mutex
+	rules map[string]*rule
+	// SafetyMargin is the fraction of every limit we keep in reserve, e.g. 0.1 only uses 90%
+	SafetyMargin float64
+	lastUpdated  time.Time
+	penaltyUntil time.Time
+	// endpoints maps the endpoints of the callers to the lowercased X-Rate-Limit-Policy PoE
+	// reported for them
+	endpoints map[string]string
+	// statePath is the file the state is shared through with other processes, if any
+	statePath string
+}
+
+func NewRateLimiter() *RateLimiter {
+	return &RateLimiter{
+		rules: map[string]*rule{
+			"account": {
+				name: "Account",
+				policies: []Policy{
+					// Default fallback limits if headers are not available
+					{MaxHits: 60, Period: 60 * time.Second},
+					{MaxHits: 120, Period: 300 * time.Second},
+					{MaxHits: 300, Period: 3600 * time.Second},
+				},
+				requestTimes: make([]time.Time, 0),
+			},
+		},
+		SafetyMargin: DefaultSafetyMargin,
+		lastUpdated:  time.Now(),
+		endpoints:    make(map[string]string),
+	}
+}
+
+var (
+	accountLimitersMutex sync.Mutex
+	accountLimiters      = make(map[string]*RateLimiter)
+)
+
+// ForAccount returns the rate limiter shared by every request made with the given session id.
+// Its state is also shared through a file with other bpl-tools processes on this machine,
+// so that all tools respect the same account limits.
+func ForAccount(sessionId string) *RateLimiter {
+	accountLimitersMutex.Lock()
+	defer accountLimitersMutex.Unlock()
+	limiter, ok := accountLimiters[sessionId]
+	if !ok {
+		limiter = NewRateLimiter()
+		limiter.statePath = sharedStatePath(sessionId)
+		accountLimiters[sessionId] = limiter
+	}
+	return limiter
+}
+
+// parseTriples parses a header like "60:60:10,120:300:300" into its numeric parts
+func parseTriples(header string) ([][3]int, error) {
+	parts := strings.Split(header, ",")
+	triples := make([][3]int, 0, len(parts))
+	for _, part := range parts {
+		values := strings.Split(strings.TrimSpace(part), ":")
+		if len(values) != 3 {
+			return nil, fmt.Errorf("invalid rate limit value %q", part)
+		}
+		var triple [3]int
+		for i, value := range values {
+			number, err := strconv.Atoi(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid rate limit value %q: %w", part, err)
+			}
+			triple[i] = number
+		}
+		triples = append(triples, triple)
+	}
+	return triples, nil
+}
+
+// UpdateFromResponse updates rate limits from the headers of a PoE API response to a request
+// to the endpoint. Every rule listed in X-Rate-Limit-Rules is tracked on its own, including
+// active restrictions. Ip and Client rules are tracked per X-Rate-Limit-Policy, the Account
+// rule is shared by all policies.
+func (rl *RateLimiter) UpdateFromResponse(endpoint string, resp *http.Response) error {
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+
+	var err error
+	rl.withSharedState(func() {
+		err = rl.updateFromResponse(endpoint, resp)
+	})
+	return err
+}
+
+func (rl *RateLimiter) updateFromResponse(endpoint string, resp *http.Response) error {
+	// X-Rate-Limit-Rules: "Account" or "Ip,Account"
+	ruleNames := strings.Split(resp.Header.Get("X-Rate-Limit-Rules"), ",")
+	if resp.Header.Get("X-Rate-Limit-Rules") == "" {
+		ruleNames = []string{"Account"}
+	}
+
+	// X-Rate-Limit-Policy: "guild-stash-history" names the set of rules of the endpoint
+	policyName := resp.Header.Get("X-Rate-Limit-Policy")
+	rl.endpoints[endpoint] = strings.ToLower(policyName)
+
+	now := time.Now()
+	updated := 0
+	for _, name := range ruleNames {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		// X-Rate-Limit-Account: "60:60:10,120:300:300,300:3600:1800" -> max_requests:window_seconds:penalty_seconds
+		limitHeader := resp.Header.Get("X-Rate-Limit-" + name)
+		// X-Rate-Limit-Account-State: "1:60:0,1:300:0,18:3600:0" -> current_requests:window_seconds:restricted_seconds
+		stateHeader := resp.Header.Get("X-Rate-Limit-" + name + "-State")
+		if limitHeader == "" || stateHeader == "" {
+			continue
+		}
+		limits, err := parseTriples(limitHeader)
+		if err != nil {
+			return fmt.Errorf("rule %s: %w", name, err)
+		}
+		states, err := parseTriples(stateHeader)
+		if err != nil {
+			return fmt.Errorf("rule %s: %w", name, err)
+		}
+		if len(limits) != len(states) {
+			return fmt.Errorf("mismatch between rate limit and state headers for rule %s", name)
+		}
+
+		key := ruleKey(policyName, name)
+		r, ok := rl.rules[key]
+		if !ok {
+			r = &rule{name: name, requestTimes: make([]time.Time, 0)}
+			if key != strings.ToLower(name) {
+				r.name = fmt.Sprintf("%s (%s)", name, policyName)
+			}
+			rl.rules[key] = r
+		}
+
+		policies := make([]Policy, 0, len(limits))
+		for i, limit := range limits {
+			policy := Policy{
+				MaxHits: limit[0],
+				Period:  time.Duration(limit[1]) * time.Second,
+				Penalty: time.Duration(limit[2]) * time.Second,
+			}
+			policies = append(policies, policy)
+
+			// Add missing timestamps to match server's reported usage
+			currentUsage := states[i][0]
+			missingHits := currentUsage - policy.CurrentHits(r.requestTimes)
+			for j := 0; j < missingHits; j++ {
+				r.requestTimes = append(r.requestTimes, now)
+			}
+
+			if restricted := time.Duration(states[i][2]) * time.Second; restricted > 0 {
+				until := now.Add(restricted)
+				if until.After(r.restrictedUntil) {
+					r.restrictedUntil = until
+				}
+			}
+		}
+		r.setPolicies(policyName, policies)
+		r.cleanExpiredRequests(now)
+		updated++
+	}
+
+	if updated == 0 {
+		return fmt.Errorf("no X-Rate-Limit headers found")
+	}
+	rl.lastUpdated = now
+	return nil
+}
+
+// Penalize blocks all requests for the given duration, e.g. after PoE answered with 429
+func (rl *RateLimiter) Penalize(duration time.Duration) {
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+	rl.withSharedState(func() {
+		until := time.Now().Add(duration)
+		if until.After(rl.penaltyUntil) {
+			rl.penaltyUntil = until
+		}
+	})
+}
+
+// ruleKeys returns the keys of the rules that limit requests to the endpoint: the Account rule
+// and the Ip and Client rules of the policy PoE reported for the endpoint. Until the first
+// response to the endpoint only the Account rule is known to apply.
+func (rl *RateLimiter) ruleKeys(endpoint string) []string {
+	policy, known := rl.endpoints[endpoint]
+	var keys []string
+	for key := range rl.rules {
+		prefix, _, scoped := strings.Cut(key, ":")
+		if key == "account" || (known && ((scoped && prefix == policy) || (!scoped && policy == ""))) {
+			keys = append(keys, key)
+		}
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+// nextFree returns the earliest time at which a request satisfies the rules with the given keys
+func (rl *RateLimiter) nextFree(now time.Time, keys []string) time.Time {
+	next := now
+	if rl.penaltyUntil.After(next) {
+		next = rl.penaltyUntil
+	}
+	for _, key := range keys {
+		if r, ok := rl.rules[key]; ok {
+			if free := r.nextFree(now, rl.SafetyMargin); free.After(next) {
+				next = free
+			}
+		}
+	}
+	return next
+}
+
+// blockedUntil returns until when penalties or active restrictions of the rules with the given
+// keys block requests
+func (rl *RateLimiter) blockedUntil(keys []string) time.Time {
+	blocked := rl.penaltyUntil
+	for _, key := range keys {
+		if r, ok := rl.rules[key]; ok && r.restrictedUntil.After(blocked) {
+			blocked = r.restrictedUntil
+		}
+	}
+	return blocked
+}
+
+// Reservation is a request slot booked with Reserve
+type Reservation struct {
+	limiter *RateLimiter
+	// keys are the rules the slot is booked in
+	keys []string
+	// At is the time at which the request may be sent
+	At time.Time
+}
+
+// Delay returns how long the caller has to wait before using the reservation
+func (r *Reservation) Delay() time.Duration {
+	return max(time.Until(r.At), 0)
+}
+
+// Cancel gives the booked slot back, e.g. because the request will not be sent after all
+func (r *Reservation) Cancel() {
+	rl := r.limiter
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+	rl.withSharedState(func() {
+		for _, key := range r.keys {
+			rule, ok := rl.rules[key]
+			if !ok {
+				continue
+			}
+			if i := slices.IndexFunc(rule.requestTimes, r.At.Equal); i >= 0 {
+				rule.requestTimes = slices.Delete(rule.requestTimes, i, i+1)
+			}
+		}
+	})
+}
+
+// Reserve books the earliest slot for a request to the endpoint that satisfies the Account
+// rule and the rules of the endpoint's policy. The slot counts against those limits right
+// away, so concurrent callers get consecutive slots.
+func (rl *RateLimiter) Reserve(endpoint string) *Reservation {
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+	reservation := &Reservation{limiter: rl}
+	rl.withSharedState(func() {
+		now := time.Now()
+		reservation.keys = rl.ruleKeys(endpoint)
+		reservation.At = rl.nextFree(now, reservation.keys)
+		for _, key := range reservation.keys {
+			r := rl.rules[key]
+			r.requestTimes = append(r.requestTimes, reservation.At)
+			r.cleanExpiredRequests(now)
+		}
+	})
+	return reservation
+}
+
+// Wait blocks until it's safe to make a request to the endpoint according to current rate
+// limits or until the context is cancelled. It returns how long the caller waited.
+func (rl *RateLimiter) Wait(ctx context.Context, endpoint string) (time.Duration, error) {
+	started := time.Now()
+	for {
+		if err := ctx.Err(); err != nil {
+			return time.Since(started), err
+		}
+		reservation := rl.Reserve(endpoint)
+		if delay := reservation.Delay(); delay > 0 {
+			timer := time.NewTimer(delay)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				reservation.Cancel()
+				return time.Since(started), ctx.Err()
+			case <-timer.C:
+			}
+		}
+
+		// A 429 or a restriction may have come in while we were sleeping
+		rl.mutex.Lock()
+		var blocked time.Time
+		rl.viewSharedState(func() {
+			blocked = rl.blockedUntil(rl.ruleKeys(endpoint))
+		})
+		rl.mutex.Unlock()
+		if time.Now().Before(blocked) {
+			reservation.Cancel()
+			continue
+		}
+		return time.Since(started), nil
+	}
+}
+
+// PolicyState is a snapshot of the usage of a single policy
+type PolicyState struct {
+	Hits             int
+	MaxHits          int
+	EffectiveMaxHits int
+	Period           time.Duration
+}
+
+// RuleState is a snapshot of a single rate limit rule such as Account or Ip
+type RuleState struct {
+	Name            string
+	Policies        []PolicyState
+	RestrictedUntil time.Time
+}
+
+// State is a snapshot of the rate limiter
+type State struct {
+	Rules        []RuleState
+	PenaltyUntil time.Time
+	// NextRequestAt is the earliest time the next request could be sent
+	NextRequestAt time.Time
+}
+
+func (s State) String() string {
+	now := time.Now()
+	states := make([]string, 0, len(s.Rules))
+	for _, r := range s.Rules {
+		policies := make([]string, len(r.Policies))
+		for i, policy := range r.Policies {
+			policies[i] = fmt.Sprintf("%d:%d:%d", policy.Hits, policy.EffectiveMaxHits, int(math.Round(policy.Period.Seconds())))
+		}
+		state := fmt.Sprintf("%s %s", r.Name, strings.Join(policies, ", "))
+		if now.Before(r.RestrictedUntil) {
+			state += fmt.Sprintf(" (restricted for %v)", r.RestrictedUntil.Sub(now).Round(time.Second))
+		}
+		states = append(states, state)
+	}
+	if now.Before(s.PenaltyUntil) {
+		states = append(states, fmt.Sprintf("penalty for %v", s.PenaltyUntil.Sub(now).Round(time.Second)))
+	}
+	return strings.Join(states, " | ")
+}
+
+// Headroom returns the fraction of the most used policy that is still available, from 0 to 1.
+// It is 0 while a penalty or restriction is active.
+func (s State) Headroom() float64 {
+	now := time.Now()
+	if s.PenaltyUntil.After(now) {
+		return 0
+	}
+	headroom := 1.0
+	for _, r := range s.Rules {
+		if r.RestrictedUntil.After(now) {
+			return 0
+		}
+		for _, policy := range r.Policies {
+			if policy.EffectiveMaxHits <= 0 {
+				continue
+			}
+			free := 1 - float64(policy.Hits)/float64(policy.EffectiveMaxHits)
+			headroom = min(headroom, max(free, 0))
+		}
+	}
+	return headroom
+}
+
+func (rl *RateLimiter) GetState() State {
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+	var state State
+	rl.viewSharedState(func() {
+		now := time.Now()
+		state.PenaltyUntil = rl.penaltyUntil
+		state.NextRequestAt = rl.nextFree(now, slices.Collect(maps.Keys(rl.rules)))
+		for _, key := range slices.Sorted(maps.Keys(rl.rules)) {
+			r := rl.rules[key]
+			ruleState := RuleState{Name: r.name, RestrictedUntil: r.restrictedUntil}
+			for _, policy := range r.policies {
+				ruleState.Policies = append(ruleState.Policies, PolicyState{
+					Hits:             policy.CurrentHits(r.requestTimes),
+					MaxHits:          policy.MaxHits,
+					EffectiveMaxHits: policy.EffectiveMaxHits(rl.SafetyMargin),
+					Period:           policy.Period,
+				})
+			}
+			state.Rules = append(state.Rules, ruleState)
+		}
+	})
+	return state
+}
@@ -0,0 +1,400 @@
+package rate_limiter
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"slices"
+	"testing"
+	"time"
+)
+
+// rateLimitResponse returns a response with the given rate limit headers
+func rateLimitResponse(headers map[string]string) *http.Response {
+	resp := &http.Response{Header: make(http.Header)}
+	for name, value := range headers {
+		resp.Header.Set(name, value)
+	}
+	return resp
+}
+
+// twoPolicyLimiter returns a limiter that saw a response of each endpoint. The Ip rule of the
+// stash policy is used up, the one of the invite policy is idle.
+func twoPolicyLimiter(t *testing.T) *RateLimiter {
+	t.Helper()
+	rl := NewRateLimiter()
+	rl.SafetyMargin = 0
+	responses := map[string]map[string]string{
+		"stash": {
+			"X-Rate-Limit-Policy":        "stash-history",
+			"X-Rate-Limit-Rules":         "Account,Ip",
+			"X-Rate-Limit-Account":       "100:60:60",
+			"X-Rate-Limit-Account-State": "1:60:0",
+			"X-Rate-Limit-Ip":            "5:60:60",
+			"X-Rate-Limit-Ip-State":      "5:60:0",
+		},
+		"invites": {
+			"X-Rate-Limit-Policy":        "private-league",
+			"X-Rate-Limit-Rules":         "Account,Ip",
+			"X-Rate-Limit-Account":       "100:60:60",
+			"X-Rate-Limit-Account-State": "1:60:0",
+			"X-Rate-Limit-Ip":            "10:60:60",
+			"X-Rate-Limit-Ip-State":      "0:60:0",
+		},
+	}
+	for endpoint, headers := range responses {
+		if err := rl.UpdateFromResponse(endpoint, rateLimitResponse(headers)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return rl
+}
+
+func TestReservePerPolicy(t *testing.T) {
+	tests := []struct {
+		name     string
+		endpoint string
+		// wantKeys are the rules the reservation is booked in
+		wantKeys    []string
+		wantDelayed bool
+	}{
+		{"policy with a used up Ip rule", "stash", []string{"account", "stash-history:ip"}, true},
+		{"policy with an idle Ip rule", "invites", []string{"account", "private-league:ip"}, false},
+		{"endpoint without a response yet", "characters", []string{"account"}, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rl := twoPolicyLimiter(t)
+			before := make(map[string]int)
+			for key, r := range rl.rules {
+				before[key] = len(r.requestTimes)
+			}
+			reservation := rl.Reserve(test.endpoint)
+			if !slices.Equal(reservation.keys, test.wantKeys) {
+				t.Errorf("booked in %v, want %v", reservation.keys, test.wantKeys)
+			}
+			if delayed := reservation.Delay() > 0; delayed != test.wantDelayed {
+				t.Errorf("delay %v, want delayed %v", reservation.Delay(), test.wantDelayed)
+			}
+			for key, r := range rl.rules {
+				want := before[key]
+				if slices.Contains(test.wantKeys, key) {
+					want++
+				}
+				if len(r.requestTimes) != want {
+					t.Errorf("rule %s has %d requests, want %d", key, len(r.requestTimes), want)
+				}
+			}
+
+			reservation.Cancel()
+			for key, r := range rl.rules {
+				if len(r.requestTimes) != before[key] {
+					t.Errorf("rule %s has %d requests after cancelling, want %d", key, len(r.requestTimes), before[key])
+				}
+			}
+		})
+	}
+}
+
+func TestReserveRestrictionPerPolicy(t *testing.T) {
+	rl := twoPolicyLimiter(t)
+	err := rl.UpdateFromResponse("stash", rateLimitResponse(map[string]string{
+		"X-Rate-Limit-Policy":   "stash-history",
+		"X-Rate-Limit-Rules":    "Ip",
+		"X-Rate-Limit-Ip":       "5:60:60",
+		"X-Rate-Limit-Ip-State": "5:60:120",
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if delay := rl.Reserve("invites").Delay(); delay != 0 {
+		t.Errorf("a restriction of the stash policy delays invites by %v", delay)
+	}
+	if delay := rl.Reserve("stash").Delay(); delay < 110*time.Second {
+		t.Errorf("stash requests are delayed by %v, want the restriction of 120s", delay)
+	}
+}
+
+func TestParseTriples(t *testing.T) {
+	tests := []struct {
+		name    string
+		header  string
+		want    [][3]int
+		wantErr bool
+	}{
+		{"single triple", "60:60:10", [][3]int{{60, 60, 10}}, false},
+		{"several triples", "60:60:10,120:300:300, 300:3600:1800", [][3]int{{60, 60, 10}, {120, 300, 300}, {300, 3600, 1800}}, false},
+		{"missing part", "60:60", nil, true},
+		{"not a number", "60:60:x", nil, true},
+		{"empty triple", "60:60:10,", nil, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := parseTriples(test.header)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("parseTriples(%q) error = %v, want error %v", test.header, err, test.wantErr)
+			}
+			if !slices.Equal(got, test.want) {
+				t.Errorf("parseTriples(%q) = %v, want %v", test.header, got, test.want)
+			}
+		})
+	}
+}
+
+func TestPolicyNextFree(t *testing.T) {
+	now := time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+	policy := Policy{MaxHits: 10, Period: time.Minute}
+	// hits returns count requests made at the given offset from now
+	hits := func(count int, offset time.Duration) []time.Time {
+		times := make([]time.Time, count)
+		for i := range times {
+			times[i] = now.Add(offset)
+		}
+		return times
+	}
+	tests := []struct {
+		name         string
+		requestTimes []time.Time
+		safetyMargin float64
+		want         time.Time
+	}{
+		{"no requests", nil, 0, now},
+		{"below the limit", hits(9, -10*time.Second), 0, now},
+		{"at the limit", hits(10, -10*time.Second), 0, now.Add(50 * time.Second)},
+		{"at the limit with a margin", hits(9, -10*time.Second), 0.1, now.Add(50 * time.Second)},
+		{"requests outside the period", hits(10, -2*time.Minute), 0, now},
+		{"oldest request frees the slot", append(hits(1, -50*time.Second), hits(9, -10*time.Second)...), 0, now.Add(10 * time.Second)},
+		{"requests booked in the future", hits(10, 30*time.Second), 0, now.Add(90 * time.Second)},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := policy.NextFree(test.requestTimes, test.safetyMargin, now); !got.Equal(test.want) {
+				t.Errorf("NextFree() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestEffectiveMaxHits(t *testing.T) {
+	tests := []struct {
+		name         string
+		maxHits      int
+		safetyMargin float64
+		want         int
+	}{
+		{"no margin", 60, 0, 60},
+		{"ten percent", 60, 0.1, 54},
+		{"rounds the reserve up", 15, 0.1, 13},
+		{"keeps one hit", 1, 0.5, 1},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			policy := Policy{MaxHits: test.maxHits, Period: time.Minute}
+			if got := policy.EffectiveMaxHits(test.safetyMargin); got != test.want {
+				t.Errorf("EffectiveMaxHits(%v) = %d, want %d", test.safetyMargin, got, test.want)
+			}
+		})
+	}
+}
+
+func TestUpdateFromResponse(t *testing.T) {
+	tests := []struct {
+		name    string
+		headers map[string]string
+		// wantHits are the requests every rule counts afterwards
+		wantHits map[string]int
+		wantErr  bool
+	}{
+		{
+			"account rule without policy",
+			map[string]string{
+				"X-Rate-Limit-Account":       "60:60:60,120:300:300",
+				"X-Rate-Limit-Account-State": "3:60:0,5:300:0",
+			},
+			map[string]int{"account": 5},
+			false,
+		},
+		{
+			"ip rule of a policy",
+			map[string]string{
+				"X-Rate-Limit-Policy":        "Stash-History",
+				"X-Rate-Limit-Rules":         "Account, Ip",
+				"X-Rate-Limit-Account":       "60:60:60",
+				"X-Rate-Limit-Account-State": "2:60:0",
+				"X-Rate-Limit-Ip":            "10:60:60",
+				"X-Rate-Limit-Ip-State":      "4:60:0",
+			},
+			map[string]int{"account": 2, "stash-history:ip": 4},
+			false,
+		},
+		{
+			"ip rule without policy",
+			map[string]string{
+				"X-Rate-Limit-Rules":    "Ip",
+				"X-Rate-Limit-Ip":       "10:60:60",
+				"X-Rate-Limit-Ip-State": "1:60:0",
+			},
+			map[string]int{"account": 0, "ip": 1},
+			false,
+		},
+		{
+			"rule without headers",
+			map[string]string{"X-Rate-Limit-Rules": "Client"},
+			map[string]int{"account": 0},
+			true,
+		},
+		{
+			"mismatching state",
+			map[string]string{
+				"X-Rate-Limit-Account":       "60:60:60,120:300:300",
+				"X-Rate-Limit-Account-State": "3:60:0",
+			},
+			map[string]int{"account": 0},
+			true,
+		},
+		{
+			"invalid limit",
+			map[string]string{
+				"X-Rate-Limit-Account":       "60:60",
+				"X-Rate-Limit-Account-State": "3:60:0",
+			},
+			map[string]int{"account": 0},
+			true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rl := NewRateLimiter()
+			err := rl.UpdateFromResponse("endpoint", rateLimitResponse(test.headers))
+			if (err != nil) != test.wantErr {
+				t.Fatalf("UpdateFromResponse() error = %v, want error %v", err, test.wantErr)
+			}
+			if len(rl.rules) != len(test.wantHits) {
+				t.Errorf("tracking %d rules, want %d", len(rl.rules), len(test.wantHits))
+			}
+			for key, want := range test.wantHits {
+				r, ok := rl.rules[key]
+				if !ok {
+					t.Errorf("rule %s is not tracked", key)
+					continue
+				}
+				if len(r.requestTimes) != want {
+					t.Errorf("rule %s has %d requests, want %d", key, len(r.requestTimes), want)
+				}
+			}
+		})
+	}
+}
+
+func TestUpdateFromResponseSharedRule(t *testing.T) {
+	rl := NewRateLimiter()
+	responses := []struct {
+		endpoint string
+		headers  map[string]string
+	}{
+		{"stash", map[string]string{
+			"X-Rate-Limit-Policy":        "stash-history",
+			"X-Rate-Limit-Account":       "30:60:60",
+			"X-Rate-Limit-Account-State": "1:60:0",
+		}},
+		{"invites", map[string]string{
+			"X-Rate-Limit-Policy":        "private-league",
+			"X-Rate-Limit-Account":       "100:300:300",
+			"X-Rate-Limit-Account-State": "1:300:0",
+		}},
+	}
+	for _, response := range responses {
+		if err := rl.UpdateFromResponse(response.endpoint, rateLimitResponse(response.headers)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := []Policy{
+		{MaxHits: 100, Period: 300 * time.Second, Penalty: 300 * time.Second},
+		{MaxHits: 30, Period: 60 * time.Second, Penalty: 60 * time.Second},
+	}
+	if got := rl.rules["account"].policies; !slices.Equal(got, want) {
+		t.Errorf("account policies = %v, want %v", got, want)
+	}
+}
+
+func TestReserveConsecutiveSlots(t *testing.T) {
+	tests := []struct {
+		name         string
+		maxHits      int
+		reservations int
+		// wantDelayed is the number of reservations that have to wait for a slot
+		wantDelayed int
+	}{
+		{"within the limit", 5, 5, 0},
+		{"beyond the limit", 5, 8, 3},
+		{"single hit per period", 1, 3, 2},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rl := NewRateLimiter()
+			rl.SafetyMargin = 0
+			rl.rules["account"].policies = []Policy{{MaxHits: test.maxHits, Period: time.Minute}}
+			var last time.Time
+			delayed := 0
+			for range test.reservations {
+				reservation := rl.Reserve("endpoint")
+				if reservation.At.Before(last) {
+					t.Errorf("slot %v is before the previous one %v", reservation.At, last)
+				}
+				last = reservation.At
+				if reservation.Delay() > 0 {
+					delayed++
+				}
+			}
+			if delayed != test.wantDelayed {
+				t.Errorf("%d reservations delayed, want %d", delayed, test.wantDelayed)
+			}
+			if got := len(rl.rules["account"].requestTimes); got != test.reservations {
+				t.Errorf("account rule has %d requests, want %d", got, test.reservations)
+			}
+		})
+	}
+}
+
+func TestWait(t *testing.T) {
+	tests := []struct {
+		name string
+		// penalty blocks every request for the duration
+		penalty time.Duration
+		timeout time.Duration
+		wantErr error
+		// wantHits is the number of requests the account rule counts afterwards
+		wantHits int
+	}{
+		{"free slot", 0, time.Second, nil, 1},
+		{"short penalty", 50 * time.Millisecond, time.Second, nil, 1},
+		{"cancelled during a penalty", time.Minute, 50 * time.Millisecond, context.DeadlineExceeded, 0},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rl := NewRateLimiter()
+			if test.penalty > 0 {
+				rl.Penalize(test.penalty)
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), test.timeout)
+			defer cancel()
+			waited, err := rl.Wait(ctx, "endpoint")
+			if !errors.Is(err, test.wantErr) {
+				t.Fatalf("Wait() error = %v, want %v", err, test.wantErr)
+			}
+			if test.wantErr == nil && waited < test.penalty {
+				t.Errorf("waited %v, want at least the penalty of %v", waited, test.penalty)
+			}
+			if got := len(rl.rules["account"].requestTimes); got != test.wantHits {
+				t.Errorf("account rule has %d requests, want %d", got, test.wantHits)
+			}
+		})
+	}
+}
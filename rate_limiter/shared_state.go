@@ -0,0 +1,207 @@
+package rate_limiter
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	// lockTimeout is how long we wait for the lock before falling back to the local state
+	lockTimeout = 5 * time.Second
+	// staleLockAge is how old a lock file has to be before we assume its owner crashed. The lock
+	// is only held for a few file operations, and this has to be well below lockTimeout so a
+	// crashed owner doesn't make everybody else time out.
+	staleLockAge = 2 * time.Second
+)
+
+// sharedState is the part of a RateLimiter that is persisted, so that every bpl-tools
+// process on this machine using the same account shares one request budget
+type sharedState struct {
+	Rules        map[string]*sharedRule `json:"rules"`
+	PenaltyUntil time.Time              `json:"penalty_until"`
+	Endpoints    map[string]string      `json:"endpoints,omitempty"`
+}
+
+type sharedRule struct {
+	Name            string              `json:"name"`
+	Policies        []Policy            `json:"policies"`
+	Sources         map[string][]Policy `json:"sources,omitempty"`
+	RequestTimes    []time.Time         `json:"request_times"`
+	RestrictedUntil time.Time           `json:"restricted_until"`
+}
+
+// sharedStatePath returns the state file for a session id. Only a hash of the
+// session id ends up on disk.
+func sharedStatePath(sessionId string) string {
+	hash := sha256.Sum256([]byte(sessionId))
+	return filepath.Join(os.TempDir(), "bpl-tools", "rate-limit-"+hex.EncodeToString(hash[:8])+".json")
+}
+
+// lockStateFile acquires an exclusive lock next to the state file. It works the same on
+// every platform because it only relies on O_EXCL file creation. The lock file holds a token
+// of its owner, so a lock that was broken as stale is never removed by its old owner.
+func lockStateFile(path string) (unlock func(), err error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return nil, err
+	}
+	lockPath := path + ".lock"
+	token := lockToken()
+	deadline := time.Now().Add(lockTimeout)
+	for {
+		file, err := os.OpenFile(lockPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+		if err == nil {
+			_, err = file.WriteString(token)
+			file.Close()
+			if err != nil {
+				os.Remove(lockPath)
+				return nil, err
+			}
+			return func() {
+				if owner, err := os.ReadFile(lockPath); err == nil && string(owner) == token {
+					os.Remove(lockPath)
+				}
+			}, nil
+		}
+		if !errors.Is(err, os.ErrExist) {
+			return nil, err
+		}
+		if breakStaleLock(lockPath) {
+			continue
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("timed out waiting for lock %s", lockPath)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// lockToken returns a token that identifies one lock acquisition
+func lockToken() string {
+	var random [8]byte
+	rand.Read(random[:])
+	return fmt.Sprintf("%d-%s", os.Getpid(), hex.EncodeToString(random[:]))
+}
+
+// breakStaleLock removes the lock file if it is older than staleLockAge. The lock is renamed
+// first and only removed if the renamed file is still stale, so a lock that was acquired
+// between the checks is put back instead of being removed.
+func breakStaleLock(lockPath string) bool {
+	info, err := os.Stat(lockPath)
+	if err != nil || time.Since(info.ModTime()) <= staleLockAge {
+		return false
+	}
+	moved := lockPath + "." + lockToken() + ".stale"
+	if err := os.Rename(lockPath, moved); err != nil {
+		return false
+	}
+	if info, err := os.Stat(moved); err == nil && time.Since(info.ModTime()) <= staleLockAge {
+		// Link fails if the lock was taken again in the meantime
+		if err := os.Link(moved, lockPath); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: Could not restore rate limit lock %s: %v\n", lockPath, err)
+		}
+	}
+	os.Remove(moved)
+	return true
+}
+
+// withSharedState runs fn after loading the shared state and persists the result afterwards.
+// The caller must hold rl.mutex. If the state file can't be used we fall back to the
+// in-memory state of this process.
+func (rl *RateLimiter) withSharedState(fn func()) {
+	rl.useSharedState(fn, true)
+}
+
+// viewSharedState is withSharedState for fn that only read the state, nothing is written back
+func (rl *RateLimiter) viewSharedState(fn func()) {
+	rl.useSharedState(fn, false)
+}
+
+func (rl *RateLimiter) useSharedState(fn func(), save bool) {
+	if rl.statePath == "" {
+		fn()
+		return
+	}
+	unlock, err := lockStateFile(rl.statePath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: Could not lock shared rate limit state: %v\n", err)
+		fn()
+		return
+	}
+	defer unlock()
+
+	if err := rl.loadSharedState(); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: Could not read shared rate limit state: %v\n", err)
+	}
+	fn()
+	if !save {
+		return
+	}
+	if err := rl.saveSharedState(); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: Could not save shared rate limit state: %v\n", err)
+	}
+}
+
+func (rl *RateLimiter) loadSharedState() error {
+	data, err := os.ReadFile(rl.statePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var state sharedState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return err
+	}
+	now := time.Now()
+	for key, saved := range state.Rules {
+		r := &rule{
+			name:            saved.Name,
+			policies:        saved.Policies,
+			sources:         saved.Sources,
+			requestTimes:    saved.RequestTimes,
+			restrictedUntil: saved.RestrictedUntil,
+		}
+		r.cleanExpiredRequests(now)
+		rl.rules[key] = r
+	}
+	if state.PenaltyUntil.After(rl.penaltyUntil) {
+		rl.penaltyUntil = state.PenaltyUntil
+	}
+	maps.Copy(rl.endpoints, state.Endpoints)
+	return nil
+}
+
+func (rl *RateLimiter) saveSharedState() error {
+	state := sharedState{
+		Rules:        make(map[string]*sharedRule, len(rl.rules)),
+		PenaltyUntil: rl.penaltyUntil,
+		Endpoints:    rl.endpoints,
+	}
+	for key, r := range rl.rules {
+		state.Rules[key] = &sharedRule{
+			Name:            r.name,
+			Policies:        r.policies,
+			Sources:         r.sources,
+			RequestTimes:    r.requestTimes,
+			RestrictedUntil: r.restrictedUntil,
+		}
+	}
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	tmp := rl.statePath + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, rl.statePath)
+}
@@ -0,0 +1,151 @@
+package rate_limiter
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// sharedLimiters returns two limiters that share their state through the same file, like two
+// bpl-tools processes using the same account
+func sharedLimiters(t *testing.T) (*RateLimiter, *RateLimiter) {
+	t.Helper()
+	statePath := filepath.Join(t.TempDir(), "rate-limit.json")
+	first, second := NewRateLimiter(), NewRateLimiter()
+	first.statePath = statePath
+	second.statePath = statePath
+	return first, second
+}
+
+func TestSharedState(t *testing.T) {
+	tests := []struct {
+		name string
+		// update changes the state of the first limiter
+		update func(t *testing.T, rl *RateLimiter)
+		// check verifies the second limiter sees the change
+		check func(t *testing.T, rl *RateLimiter)
+	}{
+		{
+			"reservations",
+			func(t *testing.T, rl *RateLimiter) {
+				rl.Reserve("endpoint")
+				rl.Reserve("endpoint")
+			},
+			func(t *testing.T, rl *RateLimiter) {
+				rl.Reserve("endpoint")
+				if got := len(rl.rules["account"].requestTimes); got != 3 {
+					t.Errorf("account rule has %d requests, want 3", got)
+				}
+			},
+		},
+		{
+			"cancelled reservation",
+			func(t *testing.T, rl *RateLimiter) {
+				rl.Reserve("endpoint").Cancel()
+			},
+			func(t *testing.T, rl *RateLimiter) {
+				rl.Reserve("endpoint")
+				if got := len(rl.rules["account"].requestTimes); got != 1 {
+					t.Errorf("account rule has %d requests, want 1", got)
+				}
+			},
+		},
+		{
+			"penalty",
+			func(t *testing.T, rl *RateLimiter) {
+				rl.Penalize(time.Minute)
+			},
+			func(t *testing.T, rl *RateLimiter) {
+				if delay := rl.Reserve("endpoint").Delay(); delay < 50*time.Second {
+					t.Errorf("delay %v, want the penalty of a minute", delay)
+				}
+			},
+		},
+		{
+			"policy of an endpoint",
+			func(t *testing.T, rl *RateLimiter) {
+				err := rl.UpdateFromResponse("stash", rateLimitResponse(map[string]string{
+					"X-Rate-Limit-Policy":   "stash-history",
+					"X-Rate-Limit-Rules":    "Ip",
+					"X-Rate-Limit-Ip":       "5:60:60",
+					"X-Rate-Limit-Ip-State": "5:60:120",
+				}))
+				if err != nil {
+					t.Fatal(err)
+				}
+			},
+			func(t *testing.T, rl *RateLimiter) {
+				if delay := rl.Reserve("stash").Delay(); delay < 110*time.Second {
+					t.Errorf("stash requests are delayed by %v, want the restriction of 120s", delay)
+				}
+				if delay := rl.Reserve("invites").Delay(); delay != 0 {
+					t.Errorf("a restriction of the stash policy delays invites by %v", delay)
+				}
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			first, second := sharedLimiters(t)
+			test.update(t, first)
+			test.check(t, second)
+		})
+	}
+}
+
+func TestLockStateFile(t *testing.T) {
+	tests := []struct {
+		name string
+		// lockAge is the age of a lock left behind by another process, if any
+		lockAge time.Duration
+	}{
+		{"no lock", 0},
+		{"stale lock", time.Minute},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			statePath := filepath.Join(t.TempDir(), "rate-limit.json")
+			lockPath := statePath + ".lock"
+			if test.lockAge > 0 {
+				if err := os.WriteFile(lockPath, []byte("crashed"), 0o600); err != nil {
+					t.Fatal(err)
+				}
+				old := time.Now().Add(-test.lockAge)
+				if err := os.Chtimes(lockPath, old, old); err != nil {
+					t.Fatal(err)
+				}
+			}
+			unlock, err := lockStateFile(statePath)
+			if err != nil {
+				t.Fatalf("lockStateFile() error = %v", err)
+			}
+			if owner, err := os.ReadFile(lockPath); err != nil || string(owner) == "crashed" {
+				t.Fatalf("lock is held by %q, %v, want our token", owner, err)
+			}
+			unlock()
+			if _, err := os.Stat(lockPath); !os.IsNotExist(err) {
+				t.Errorf("lock still exists after unlocking: %v", err)
+			}
+		})
+	}
+}
+
+func TestUnlockBrokenLock(t *testing.T) {
+	statePath := filepath.Join(t.TempDir(), "rate-limit.json")
+	lockPath := statePath + ".lock"
+	unlock, err := lockStateFile(statePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Another process broke our lock as stale and took it
+	if err := os.WriteFile(lockPath, []byte("other"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	unlock()
+	if owner, err := os.ReadFile(lockPath); err != nil || string(owner) != "other" {
+		t.Errorf("lock of the other process is %q, %v after unlocking, want it kept", owner, err)
+	}
+}